@@ -11,4 +11,6 @@ require (
 	github.com/mattn/go-colorable v0.1.7 // indirect
 	github.com/miekg/dns v1.1.30
 	github.com/ooni/probe-engine v0.15.0
+	golang.org/x/net v0.0.0-20200707034311-ab3426394381
+	golang.org/x/sys v0.0.0-20200720211630-cb9d2d5c5666
 )
@@ -0,0 +1,146 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// DefaultBlockpage is the name of the default blockpage.
+const DefaultBlockpage = "451"
+
+// Blockpage is a blockpage. It is a text/template that renders a raw
+// HTTP response, i.e., the status line, the headers, an empty line,
+// and the body. The template data is the *http.Request. Since the
+// request comes from the client, escape the fields of the request
+// used in the body (e.g., `{{.Host | html}}`).
+type Blockpage struct {
+	tmpl *template.Template
+}
+
+// NewBlockpage creates a new Blockpage from the text of its template.
+func NewBlockpage(name, text string) (*Blockpage, error) {
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &Blockpage{tmpl: tmpl}, nil
+}
+
+// Render renders the blockpage for r.
+func (bp *Blockpage) Render(r *http.Request) (*http.Response, error) {
+	var buf bytes.Buffer
+	if err := bp.tmpl.Execute(&buf, r); err != nil {
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return resp, nil
+}
+
+// Blockpages is a catalogue of blockpages indexed by name.
+type Blockpages map[string]*Blockpage
+
+// DefaultBlockpages returns a catalogue containing the bundled blockpages,
+// i.e., "451" (the default), "isp-200", "redirect-302", "forbidden-403",
+// and "iframe-200".
+func DefaultBlockpages() Blockpages {
+	out := make(Blockpages)
+	for name, text := range bundledBlockpages {
+		bp, err := NewBlockpage(name, text)
+		if err != nil {
+			panic(err) // bundled blockpages are always valid
+		}
+		out[name] = bp
+	}
+	return out
+}
+
+// Load adds to the catalogue the blockpages contained in the `*.tmpl`
+// files in dir. The name of each blockpage is the name of its file
+// without extension. A blockpage may replace a bundled blockpage.
+func (b Blockpages) Load(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(filepath.Base(file), ".tmpl")
+		bp, err := NewBlockpage(name, string(data))
+		if err != nil {
+			return err
+		}
+		b[name] = bp
+	}
+	return nil
+}
+
+var bundledBlockpages = map[string]string{
+	"451": `HTTP/1.1 451 Unavailable For Legal Reasons
+Content-Type: text/html
+
+<html><head>
+  <title>451 Unavailable For Legal Reasons</title>
+</head><body>
+  <center><h1>451 Unavailable For Legal Reasons</h1></center>
+  <p>This content is not available in your jurisdiction.</p>
+</body></html>
+`,
+
+	"isp-200": `HTTP/1.1 200 OK
+Content-Type: text/html; charset=utf-8
+Cache-Control: no-cache
+
+<html><head>
+  <title>Access restricted</title>
+</head><body>
+  <h1>Access to {{.Host | html}} has been restricted</h1>
+  <p>Access to this resource has been restricted by decision of the
+  competent authorities in accordance with the law.</p>
+</body></html>
+`,
+
+	"redirect-302": `HTTP/1.1 302 Found
+Location: http://warning.isp.example/?url={{printf "http://%s%s" .Host .URL.RequestURI | urlquery}}
+Content-Type: text/html
+
+<html><body><a href="http://warning.isp.example/">Moved</a></body></html>
+`,
+
+	"forbidden-403": `HTTP/1.1 403 Forbidden
+Server: Protected by WireFilter 8000 (HTTP-ISP)
+Content-Type: text/html
+
+<html><head><title>403 Forbidden</title></head><body>
+  <h1>Forbidden</h1>
+  <p>You don't have permission to access {{.URL.Path | html}} on this server.</p>
+</body></html>
+`,
+
+	"iframe-200": `HTTP/1.1 200 OK
+Content-Type: text/html
+Connection: close
+
+<html><head><meta http-equiv="Content-Type" content="text/html; charset=windows-1256"><title>M1-6
+</title></head><body><iframe src="http://10.10.34.34?type=Invalid Site&policy=MainPolicy " style="width: 100%; height: 100%" scrolling="no" marginwidth="0" marginheight="0" frameborder="0" vspace="0" hspace="0"></iframe></body></html>
+`,
+}
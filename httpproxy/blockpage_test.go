@@ -0,0 +1,127 @@
+package httpproxy
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDefaultBlockpages(t *testing.T) {
+	expect := map[string]int{
+		"451":           451,
+		"isp-200":       200,
+		"redirect-302":  302,
+		"forbidden-403": 403,
+		"iframe-200":    200,
+	}
+	blockpages := DefaultBlockpages()
+	if len(blockpages) != len(expect) {
+		t.Fatal("unexpected number of blockpages")
+	}
+	req := httptest.NewRequest("GET", "http://www.example.com/antani?x=1", nil)
+	for name, status := range expect {
+		resp, err := blockpages[name].Render(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != status {
+			t.Fatalf("%s: unexpected status code", name)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.ContentLength != int64(len(body)) || len(body) <= 0 {
+			t.Fatalf("%s: unexpected content length", name)
+		}
+	}
+	resp, err := blockpages["redirect-302"].Render(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	location := "http://warning.isp.example/?url=http%3A%2F%2Fwww.example.com%2Fantani%3Fx%3D1"
+	if resp.Header.Get("Location") != location {
+		t.Fatal("unexpected Location header")
+	}
+}
+
+func TestDefaultBlockpagesEscaping(t *testing.T) {
+	blockpages := DefaultBlockpages()
+	req := httptest.NewRequest("GET", "http://www.example.com/%3Cscript%3E", nil)
+	req.Host = "<script>alert(1)</script>"
+	for _, name := range []string{"isp-200", "forbidden-403"} {
+		resp, err := blockpages[name].Render(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(body), "<script>") {
+			t.Fatalf("%s: request fields not escaped", name)
+		}
+	}
+}
+
+func TestNewBlockpageError(t *testing.T) {
+	bp, err := NewBlockpage("antani", "{{")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if bp != nil {
+		t.Fatal("expected nil blockpage here")
+	}
+}
+
+func TestBlockpageRenderErrors(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://www.example.com/", nil)
+	for _, text := range []string{
+		"{{.Antani}}",
+		"this is not an HTTP response",
+	} {
+		bp, err := NewBlockpage("antani", text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bp.Render(req); err == nil {
+			t.Fatalf("expected an error for %q", text)
+		}
+	}
+}
+
+func TestBlockpagesLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jafar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	text := "HTTP/1.1 200 OK\nX-Host: {{.Host}}\n\nblocked\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "custom.tmpl"), []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+	blockpages := DefaultBlockpages()
+	if err := blockpages.Load(dir); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "http://www.example.com/", nil)
+	resp, err := blockpages["custom"].Render(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 || resp.Header.Get("X-Host") != "www.example.com" {
+		t.Fatal("unexpected response")
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken.tmpl"), []byte("{{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := blockpages.Load(dir); err == nil {
+		t.Fatal("expected an error here")
+	}
+	if err := blockpages.Load("["); err == nil {
+		t.Fatal("expected an error here")
+	}
+}
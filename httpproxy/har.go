@@ -0,0 +1,396 @@
+package httpproxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultHARMaxBodySize is the default maximum number of bytes of each
+// request and response body recorded by HARRecorder.
+const DefaultHARMaxBodySize = 1 << 16
+
+// DefaultHARMaxEntries is the default maximum number of entries
+// recorded by HARRecorder.
+const DefaultHARMaxEntries = 1 << 10
+
+// HARRecorder records the requests served by the proxy and the related
+// responses in HAR 1.2 format. In addition to the standard fields, each
+// entry contains the `_jafarRule` field, i.e., the rule that matched
+// the request, if any. We record the response seen by the client, thus
+// the response of a request failed at the connection level is empty.
+//
+// We keep the entries in memory until WriteFile, thus we stop recording
+// after MaxEntries entries and count the entries we drop. WriteFile tells
+// how many entries we dropped using the comment of the log.
+type HARRecorder struct {
+	// MaxBodySize is the maximum number of bytes of each body we
+	// record. NewHARRecorder initializes it to DefaultHARMaxBodySize.
+	MaxBodySize int
+
+	// MaxEntries is the maximum number of entries we record. NewHARRecorder
+	// initializes it to DefaultHARMaxEntries.
+	MaxEntries int
+
+	dropped int
+	entries []harEntry
+	mu      sync.Mutex
+	now     func() time.Time
+}
+
+// NewHARRecorder creates a new HARRecorder.
+func NewHARRecorder() *HARRecorder {
+	return &HARRecorder{
+		MaxBodySize: DefaultHARMaxBodySize,
+		MaxEntries:  DefaultHARMaxEntries,
+		now:         time.Now,
+	}
+}
+
+// WriteFile writes the recorded entries into the file at path.
+func (h *HARRecorder) WriteFile(path string) error {
+	h.mu.Lock()
+	entries, dropped := append([]harEntry{}, h.entries...), h.dropped
+	h.mu.Unlock()
+	var comment string
+	if dropped > 0 {
+		comment = fmt.Sprintf("jafar: dropped %d entries after the first %d", dropped, len(entries))
+	}
+	data, err := json.MarshalIndent(harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "jafar", Version: "0.1.0"},
+		Pages:   []struct{}{},
+		Entries: entries,
+		Comment: comment,
+	}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Pages   []struct{} `json:"pages"`
+	Entries []harEntry `json:"entries"`
+	Comment string     `json:"comment,omitempty"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	JafarRule       string      `json:"_jafarRule,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string         `json:"mimeType"`
+	Params   []harNameValue `json:"params"`
+	Text     string         `json:"text"`
+	Comment  string         `json:"comment,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// start starts recording r, which rule matched, and returns the response
+// writer to use to record the response. Call done when done with r.
+func (h *HARRecorder) start(w http.ResponseWriter, r *http.Request, rule *Rule) *harResponseWriter {
+	body := peekbody(r, h.MaxBodySize+1)
+	entry := harEntry{
+		Request: harRequest{
+			Method:      r.Method,
+			URL:         requestURL(r),
+			HTTPVersion: r.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     harheaders(r.Header),
+			QueryString: harquery(r),
+			HeadersSize: -1,
+			BodySize:    int64(len(body)),
+		},
+	}
+	for _, cookie := range r.Cookies() {
+		entry.Request.Cookies = append(entry.Request.Cookies, harNameValue{
+			Name: cookie.Name, Value: cookie.Value,
+		})
+	}
+	if len(body) > 0 {
+		// Implementation note: postData has no encoding field, thus we
+		// use the comment to tell that the text is base64 encoded.
+		var comments []string
+		text, encoding := harbody(body, h.MaxBodySize)
+		if encoding != "" {
+			comments = append(comments, encoding)
+		}
+		if len(body) > h.MaxBodySize {
+			comments = append(comments, "truncated")
+		}
+		entry.Request.PostData = &harPostData{
+			MimeType: r.Header.Get("Content-Type"),
+			Params:   []harNameValue{},
+			Text:     text,
+			Comment:  strings.Join(comments, ", "),
+		}
+	}
+	if rule != nil {
+		entry.JafarRule = rule.text
+	}
+	var reqbody *countingBody
+	if r.Body != nil {
+		reqbody = &countingBody{ReadCloser: r.Body}
+		r.Body = reqbody
+	}
+	return &harResponseWriter{
+		ResponseWriter: w,
+		entry:          entry,
+		proto:          r.Proto,
+		recorder:       h,
+		reqbody:        reqbody,
+		start:          h.now(),
+	}
+}
+
+// countingBody is a request body counting the bytes read from it.
+type countingBody struct {
+	io.ReadCloser
+	count int64
+}
+
+// Read implements io.Reader.Read.
+func (b *countingBody) Read(p []byte) (int, error) {
+	count, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.count, int64(count))
+	return count, err
+}
+
+// requestURL returns the absolute URL of r.
+func requestURL(r *http.Request) string {
+	switch {
+	case r.Method == http.MethodConnect:
+		return r.Host
+	case r.URL.IsAbs():
+		return r.URL.String()
+	default:
+		return "http://" + r.Host + r.URL.RequestURI()
+	}
+}
+
+// harheaders converts headers to HAR, sorting them by name.
+func harheaders(headers http.Header) []harNameValue {
+	out := []harNameValue{}
+	for name, values := range headers {
+		for _, value := range values {
+			out = append(out, harNameValue{Name: name, Value: value})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// harquery converts the query of r to HAR, sorting it by name.
+func harquery(r *http.Request) []harNameValue {
+	out := []harNameValue{}
+	for name, values := range r.URL.Query() {
+		for _, value := range values {
+			out = append(out, harNameValue{Name: name, Value: value})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// harbody returns the text of the first max bytes of body and the
+// related encoding, which is empty for UTF-8 text and base64 otherwise.
+func harbody(body []byte, max int) (string, string) {
+	if len(body) > max {
+		body = body[:max]
+	}
+	if utf8.Valid(body) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+// harResponseWriter records the response.
+type harResponseWriter struct {
+	http.ResponseWriter
+	body     []byte
+	entry    harEntry
+	headers  http.Header
+	proto    string
+	recorder *HARRecorder
+	reqbody  *countingBody
+	size     int64
+	start    time.Time
+	status   int
+	wait     time.Duration
+}
+
+// WriteHeader implements http.ResponseWriter.WriteHeader.
+func (w *harResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.headers = w.Header().Clone()
+		w.wait = w.recorder.now().Sub(w.start)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.Write.
+func (w *harResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if room := w.recorder.MaxBodySize + 1 - len(w.body); room > 0 {
+		if room > len(b) {
+			room = len(b)
+		}
+		w.body = append(w.body, b[:room]...)
+	}
+	count, err := w.ResponseWriter.Write(b)
+	w.size += int64(count)
+	return count, err
+}
+
+// Flush implements http.Flusher.Flush.
+func (w *harResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker.Hijack.
+func (w *harResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("httpproxy: cannot hijack the connection")
+	}
+	return hijacker.Hijack()
+}
+
+// done completes the entry and adds it to the recorder.
+func (w *harResponseWriter) done() {
+	elapsed := w.recorder.now().Sub(w.start)
+	if w.status == 0 {
+		w.wait = elapsed
+	}
+	entry := w.entry
+	// The request body size is the number of bytes we have read, which
+	// may be more than the bytes we peeked when forwarding the request.
+	if w.reqbody != nil {
+		if count := atomic.LoadInt64(&w.reqbody.count); count > entry.Request.BodySize {
+			entry.Request.BodySize = count
+		}
+	}
+	entry.StartedDateTime = w.start.Format(time.RFC3339Nano)
+	entry.Time = milliseconds(elapsed)
+	entry.Timings = harTimings{
+		Wait:    milliseconds(w.wait),
+		Receive: milliseconds(elapsed - w.wait),
+	}
+	entry.Response = harResponse{
+		Status:      w.status,
+		StatusText:  http.StatusText(w.status),
+		HTTPVersion: w.proto,
+		Cookies:     []harNameValue{},
+		Headers:     harheaders(w.headers),
+		Content: harContent{
+			Size:     w.size,
+			MimeType: w.headers.Get("Content-Type"),
+		},
+		RedirectURL: w.headers.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    w.size,
+	}
+	if w.status == 0 {
+		entry.Response.HTTPVersion = ""
+		entry.Response.BodySize = -1
+	}
+	for _, cookie := range (&http.Response{Header: w.headers}).Cookies() {
+		entry.Response.Cookies = append(entry.Response.Cookies, harNameValue{
+			Name: cookie.Name, Value: cookie.Value,
+		})
+	}
+	entry.Response.Content.Text, entry.Response.Content.Encoding = harbody(
+		w.body, w.recorder.MaxBodySize)
+	if len(w.body) > w.recorder.MaxBodySize {
+		entry.Response.Content.Comment = "truncated"
+	}
+	w.recorder.mu.Lock()
+	if len(w.recorder.entries) < w.recorder.MaxEntries {
+		w.recorder.entries = append(w.recorder.entries, entry)
+	} else {
+		w.recorder.dropped++
+	}
+	w.recorder.mu.Unlock()
+}
+
+// milliseconds converts d to milliseconds.
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
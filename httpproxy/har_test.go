@@ -0,0 +1,199 @@
+package httpproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ooni/jafar/uncensored"
+)
+
+func TestHARRecorder(t *testing.T) {
+	proxy, err := NewCensoringProxy([]string{
+		"blocked.example",
+		"reset.example:reset",
+	}, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.HAR = NewHARRecorder()
+	proxy.HAR.MaxBodySize = 8
+	binary := strings.Repeat("\xff", 16)
+	proxy.transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil || (string(body) != "antani" && string(body) != binary) {
+			return nil, errors.New("unexpected request body")
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Header: http.Header{
+				"Content-Type": {"text/plain"},
+				"Set-Cookie":   {"session=xyz"},
+			},
+			Body: ioutil.NopCloser(strings.NewReader("hello, world")),
+		}, nil
+	})
+	server, addr, err := proxy.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer killproxy(t, server)
+	req, err := http.NewRequest("POST", "http://"+addr.String()+"/x?q=1", strings.NewReader("antani"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "allowed.example"
+	// Disable keep alives so the client does not retry after a reset
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	// Hide the length of the body, such that the client uses chunking
+	req, err = http.NewRequest("POST", "http://"+addr.String(),
+		ioutil.NopCloser(strings.NewReader(binary)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "binary.example"
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, host := range []string{"blocked.example", "reset.example"} {
+		req, err := http.NewRequest("GET", "http://"+addr.String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+	// The client may see the reset before we record the request
+	recorded := func() int {
+		proxy.HAR.mu.Lock()
+		defer proxy.HAR.mu.Unlock()
+		return len(proxy.HAR.entries)
+	}
+	for i := 0; i < 100 && recorded() < 4; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	dir, err := ioutil.TempDir("", "jafar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jafar.har")
+	if err := proxy.HAR.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		t.Fatal(err)
+	}
+	if har.Log.Version != "1.2" || len(har.Log.Entries) != 4 {
+		t.Fatal("unexpected log")
+	}
+	entries := make(map[string]harEntry)
+	for _, entry := range har.Log.Entries {
+		entries[entry.Request.URL] = entry
+	}
+	allowed := entries["http://allowed.example/x?q=1"]
+	if allowed.Request.Method != "POST" || allowed.Request.PostData == nil ||
+		allowed.Request.PostData.Text != "antani" || allowed.Request.BodySize != 6 {
+		t.Fatal("unexpected request")
+	}
+	if len(allowed.Request.QueryString) != 1 || allowed.Request.QueryString[0].Value != "1" {
+		t.Fatal("unexpected query string")
+	}
+	if allowed.Response.Status != 200 || allowed.Response.Content.Text != "hello, w" ||
+		allowed.Response.Content.Size != 12 || allowed.Response.Content.Comment != "truncated" {
+		t.Fatal("unexpected response")
+	}
+	if len(allowed.Response.Cookies) != 1 || allowed.Response.Cookies[0].Value != "xyz" {
+		t.Fatal("unexpected response cookies")
+	}
+	if allowed.JafarRule != "" {
+		t.Fatal("unexpected rule")
+	}
+	chunked := entries["http://binary.example/"]
+	if chunked.Request.PostData == nil || chunked.Request.PostData.Text != "//////////8=" ||
+		chunked.Request.PostData.Comment != "base64, truncated" || chunked.Request.BodySize != 16 {
+		t.Fatal("unexpected chunked request")
+	}
+	blocked := entries["http://blocked.example/"]
+	if blocked.Response.Status != 451 || blocked.JafarRule != "blocked.example" {
+		t.Fatal("unexpected blocked entry")
+	}
+	reset := entries["http://reset.example/"]
+	if reset.Response.Status != 0 || reset.JafarRule != "reset.example:reset" {
+		t.Fatal("unexpected reset entry")
+	}
+}
+
+func TestHARRecorderMaxEntries(t *testing.T) {
+	recorder := NewHARRecorder()
+	recorder.MaxEntries = 2
+	for _, path := range []string{"/a", "/b", "/c"} {
+		req := httptest.NewRequest("GET", "http://www.example.com"+path, nil)
+		w := recorder.start(httptest.NewRecorder(), req, nil)
+		w.WriteHeader(204)
+		w.done()
+	}
+	dir, err := ioutil.TempDir("", "jafar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "jafar.har")
+	if err := recorder.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		t.Fatal(err)
+	}
+	if len(har.Log.Entries) != 2 || har.Log.Entries[1].Request.URL != "http://www.example.com/b" {
+		t.Fatal("unexpected entries")
+	}
+	if har.Log.Comment != "jafar: dropped 1 entries after the first 2" {
+		t.Fatal("unexpected comment")
+	}
+}
+
+func TestHARBody(t *testing.T) {
+	text, encoding := harbody([]byte{0xff, 0xfe, 0xfd}, 2)
+	if text != "//4=" || encoding != "base64" {
+		t.Fatal("unexpected binary body")
+	}
+	text, encoding = harbody([]byte("antani"), 10)
+	if text != "antani" || encoding != "" {
+		t.Fatal("unexpected text body")
+	}
+}
+
+func TestHARWriteFileError(t *testing.T) {
+	if err := NewHARRecorder().WriteFile(""); err == nil {
+		t.Fatal("expected an error here")
+	}
+}
@@ -2,77 +2,403 @@
 package httpproxy
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"strings"
 
+	"github.com/ooni/jafar/internal/origdst"
 	"github.com/ooni/probe-engine/netx/httptransport"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 const product = "jafar/0.1.0"
 
+// maxBodySize is the maximum number of body bytes we inspect.
+const maxBodySize = 1 << 20
+
 // CensoringProxy is a censoring HTTP proxy
 type CensoringProxy struct {
-	keywords  []string
+	// Blockpages is the catalogue of blockpages that rules may use.
+	// NewCensoringProxy initializes it using DefaultBlockpages.
+	Blockpages Blockpages
+
+	// OriginalDst indicates whether to forward the requests received
+	// over connections redirected to us using iptables to their original
+	// destination, rather than to the address of the Host.
+	OriginalDst bool
+
+	// ForwardH2C indicates whether to forward the requests received
+	// over h2c using h2c with prior knowledge, rather than HTTP/1.1.
+	ForwardH2C bool
+
+	// Stealth indicates whether to refrain from adding the Via and
+	// X-Forwarded-For headers when forwarding.
+	Stealth bool
+
+	// HAR, when not nil, records the requests and the responses.
+	HAR *HARRecorder
+
+	dial      func(network, address string) (net.Conn, error)
+	h2c       http.RoundTripper
+	listener  net.Addr
+	needsBody bool
+	own       sockets
+	rules     []*Rule
 	transport http.RoundTripper
 }
 
+// Uncensored is the upstream, non censored client we use to forward
+// requests and to connect to the targets of CONNECT requests.
+type Uncensored interface {
+	httptransport.Dialer
+	httptransport.RoundTripper
+}
+
 // NewCensoringProxy creates a new CensoringProxy instance using
-// the specified list of keywords to censor. keywords is the list
-// of keywords that trigger censorship if any of them appears in
-// the Host header of a request. dnsNetwork and dnsAddress are
-// settings to configure the upstream, non censored DNS.
+// the specified list of rules (see ParseRule). In its simplest form,
+// a rule is a keyword that triggers censorship if it appears in the
+// Host header of a request. uncensored is the upstream, non censored
+// client we use to forward requests.
 func NewCensoringProxy(
-	keywords []string, uncensored httptransport.RoundTripper,
-) *CensoringProxy {
-	return &CensoringProxy{keywords: keywords, transport: uncensored}
+	rules []string, uncensored Uncensored,
+) (*CensoringProxy, error) {
+	parsed, err := ParseRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	p := &CensoringProxy{
+		Blockpages: DefaultBlockpages(),
+		dial: func(network, address string) (net.Conn, error) {
+			return uncensored.DialContext(context.Background(), network, address)
+		},
+		rules:     parsed,
+		transport: uncensored,
+	}
+	p.h2c = &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, address string, config *tls.Config) (net.Conn, error) {
+			return p.dial(network, address)
+		},
+	}
+	for _, rule := range parsed {
+		p.needsBody = p.needsBody || rule.Body != nil
+	}
+	return p, nil
 }
 
-var blockpage = []byte(`<html><head>
-  <title>451 Unavailable For Legal Reasons</title>
-</head><body>
-  <center><h1>451 Unavailable For Legal Reasons</h1></center>
-  <p>This content is not available in your jurisdiction.</p>
-</body></html>
-`)
-
-// ServeHTTP serves HTTP requests
+// ServeHTTP serves HTTP requests. We act as a transparent proxy for
+// requests in origin form and as an explicit proxy for requests in
+// absolute form and for CONNECT requests. In all cases, rules match
+// against the target host, which for CONNECT includes the port. With
+// HTTP/2, connection-level failures reset the stream. We reply with 400
+// to requests we are forwarding to ourselves.
 func (p *CensoringProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Implementation note: use Via header to detect in a loose way
-	// requests originated by us and directed to us
-	if r.Header.Get("Via") != "" || r.Host == "" {
+	if r.Host == "" || p.own.has(r.RemoteAddr) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	for _, pattern := range p.keywords {
-		if strings.Contains(r.Host, pattern) {
-			w.WriteHeader(http.StatusUnavailableForLegalReasons)
-			w.Write(blockpage)
-			return
-		}
+	rule := p.match(r)
+	if p.HAR != nil {
+		hw := p.HAR.start(w, r, rule)
+		defer hw.done()
+		w = hw
+	}
+	switch {
+	case rule == nil, rule.Action == ActionTamper:
+	case rule.Action == ActionBlock:
+		p.block(w, r, rule)
+		return
+	default:
+		p.fail(w, r, rule)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		// Implementation note: we cannot tamper with the tunnel
+		p.connect(w, r)
+		return
+	}
+	scheme := "http"
+	if r.URL.IsAbs() {
+		scheme = r.URL.Scheme
+	}
+	if scheme != "http" && scheme != "https" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if rule != nil && rule.Tamper.Body != nil {
+		// Make sure we receive a body we can modify
+		r.Header.Del("Accept-Encoding")
+	}
+	host := r.Host
+	if p.OriginalDst && !r.URL.IsAbs() {
+		host = originalDst(r)
+	}
+	defaultPort := "80"
+	if scheme == "https" {
+		defaultPort = "443"
+	}
+	if isself(p.listener, host, defaultPort) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !p.Stealth {
+		r.Header.Add("Via", product)
 	}
-	r.Header.Add("Via", product) // see above
 	proxy := httputil.NewSingleHostReverseProxy(&url.URL{
-		Host:   r.Host,
-		Scheme: "http",
+		Host:   host,
+		Scheme: scheme,
 	})
 	proxy.ModifyResponse = func(resp *http.Response) error {
-		resp.Header.Add("Via", product) // see above
+		if !p.Stealth {
+			resp.Header.Add("Via", product)
+		}
+		if rule != nil {
+			return rule.Tamper.apply(resp)
+		}
 		return nil
 	}
 	proxy.Transport = p.transport
-	proxy.ServeHTTP(w, r)
+	if p.ForwardH2C && r.ProtoMajor == 2 && scheme == "http" {
+		proxy.Transport = p.h2c
+	}
+	if p.Stealth {
+		proxy.Transport = &stealthTransport{RoundTripper: proxy.Transport}
+	}
+	ctx, done := p.own.trace(r.Context())
+	defer done()
+	proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// stealthTransport is a transport removing the X-Forwarded-For header
+// that httputil.ReverseProxy adds. Implementation note: since go1.15,
+// a nil header value also prevents adding it, but we support go1.14.
+type stealthTransport struct {
+	http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.RoundTrip.
+func (t *stealthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Del("X-Forwarded-For")
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// connKey is the context key for the connection of a request.
+type connKey struct{}
+
+// originalDst returns the original destination of the connection
+// of r or, on failure, the Host of r.
+func originalDst(r *http.Request) string {
+	if conn, ok := r.Context().Value(connKey{}).(net.Conn); ok {
+		if addr, err := origdst.Get(conn); err == nil {
+			return addr.String()
+		}
+	}
+	return r.Host
+}
+
+// connect serves a CONNECT request by connecting to the target and then
+// routing traffic between the client and the target.
+func (p *CensoringProxy) connect(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	if isself(p.listener, r.Host, "443") {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	serverconn, err := p.dial("tcp", r.Host)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	// Register the connection before writing anything, such that we
+	// detect a loop even if we serve the looping request right away.
+	p.own.add(serverconn.LocalAddr())
+	defer p.own.remove(serverconn.LocalAddr())
+	clientconn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		serverconn.Close()
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	_, err = clientconn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	if err == nil && bufrw.Reader.Buffered() > 0 {
+		// Forward what the client sent after the request
+		data, _ := bufrw.Reader.Peek(bufrw.Reader.Buffered())
+		_, err = serverconn.Write(data)
+	}
+	if err != nil {
+		clientconn.Close()
+		serverconn.Close()
+		return
+	}
+	splice(clientconn, serverconn)
 }
 
-// Start starts the censoring proxy.
+// splice routes traffic between left and right until either of them
+// is closed and then closes both.
+func splice(left, right net.Conn) {
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(left, right)
+		done <- true
+	}()
+	go func() {
+		io.Copy(right, left)
+		done <- true
+	}()
+	<-done
+	left.Close()
+	right.Close()
+	<-done
+}
+
+// block replies to r using the blockpage selected by rule.
+func (p *CensoringProxy) block(w http.ResponseWriter, r *http.Request, rule *Rule) {
+	resp, err := p.render(r, rule)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// render renders the blockpage selected by rule for r.
+func (p *CensoringProxy) render(r *http.Request, rule *Rule) (*http.Response, error) {
+	bp, found := p.Blockpages[rule.Blockpage]
+	if !found {
+		return nil, fmt.Errorf("httpproxy: unknown blockpage: %s", rule.Blockpage)
+	}
+	return bp.Render(r)
+}
+
+// fail implements the connection-level failures, i.e., all the actions
+// except ActionBlock and ActionTamper. When we cannot take control of the
+// connection (e.g., with HTTP/2), we abort the handler instead.
+func (p *CensoringProxy) fail(w http.ResponseWriter, r *http.Request, rule *Rule) {
+	var partial []byte
+	if rule.Action == ActionTruncate {
+		resp, err := p.render(r, rule)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var buf bytes.Buffer
+		resp.Write(&buf)
+		partial = buf.Bytes()
+		switch {
+		case rule.Truncate <= 0:
+			partial = partial[:len(partial)/2]
+		case rule.Truncate < len(partial):
+			partial = partial[:rule.Truncate]
+		default:
+			// Make sure that we actually truncate the response
+			partial = partial[:len(partial)-1]
+		}
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	switch rule.Action {
+	case ActionReset:
+		reset(conn)
+	case ActionHang:
+		// Read and discard until the client gives up
+		io.Copy(ioutil.Discard, conn)
+		conn.Close()
+	case ActionTruncate:
+		conn.Write(partial)
+		conn.Close()
+	default:
+		conn.Close()
+	}
+}
+
+// reset closes the connection with a RST segment
+func reset(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// match returns the first rule matching r or nil.
+func (p *CensoringProxy) match(r *http.Request) *Rule {
+	var body []byte
+	if p.needsBody {
+		body = peekbody(r, maxBodySize)
+	}
+	for _, rule := range p.rules {
+		if rule.match(r, body) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// peekbody returns the first limit bytes of the body of r and arranges
+// for r.Body to still return the whole body when read again.
+func peekbody(r *http.Request, limit int) []byte {
+	if r.Body == nil {
+		return nil
+	}
+	// Implementation note: we ignore the error and just inspect the
+	// bytes we could read. Then, proxying the request will fail.
+	body, _ := ioutil.ReadAll(io.LimitReader(r.Body, int64(limit)))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	return body
+}
+
+// Start starts the censoring proxy, which also accepts h2c, using both
+// prior knowledge and the upgrade mechanism. It fails if any rule refers to
+// a blockpage that is not in p.Blockpages.
 func (p *CensoringProxy) Start(address string) (*http.Server, net.Addr, error) {
-	server := &http.Server{Handler: p}
+	for _, rule := range p.rules {
+		if _, found := p.Blockpages[rule.Blockpage]; !found {
+			return nil, nil, fmt.Errorf("httpproxy: unknown blockpage: %s", rule.Blockpage)
+		}
+	}
+	h2s := &http2.Server{}
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Implementation note: the h2c handler does not propagate
+			// the context of the request to the streams
+			conn := r.Context().Value(connKey{})
+			h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				p.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), connKey{}, conn)))
+			}), h2s).ServeHTTP(w, r)
+		}),
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, connKey{}, conn)
+		},
+	}
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		return nil, nil, err
 	}
+	p.listener = listener.Addr()
 	go server.Serve(listener)
 	return server, listener.Addr(), nil
 }
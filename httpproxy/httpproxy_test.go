@@ -1,14 +1,26 @@
 package httpproxy
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/ooni/jafar/uncensored"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func TestIntegrationPass(t *testing.T) {
@@ -31,18 +43,18 @@ func TestIntegrationBlock(t *testing.T) {
 
 func TestIntegrationLoop(t *testing.T) {
 	server, addr := newproxy(t, "ooni.io")
-	// Here we're forcing the proxy to connect to itself. It does
-	// does that and recognizes itself because of the Via header
-	// being set in the request generated by the connection to itself,
-	// which should cause a 400. The response should have the Via
-	// header set because the 400 is received by the connection that
-	// this code has made to the proxy.
-	checkrequest(t, addr.String(), addr.String(), 400, true)
+	// Here we're forcing the proxy to connect to itself. It recognizes
+	// that the destination is its own address and replies with 400
+	// without forwarding, hence there should be no Via header.
+	checkrequest(t, addr.String(), addr.String(), 400, false)
 	killproxy(t, server)
 }
 
 func TestIntegrationListenError(t *testing.T) {
-	proxy := NewCensoringProxy([]string{""}, uncensored.DefaultClient)
+	proxy, err := NewCensoringProxy([]string{""}, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
 	server, addr, err := proxy.Start("8.8.8.8:80")
 	if err == nil {
 		t.Fatal("expected an error here")
@@ -55,8 +67,646 @@ func TestIntegrationListenError(t *testing.T) {
 	}
 }
 
+func TestNewCensoringProxyInvalidRule(t *testing.T) {
+	proxy, err := NewCensoringProxy([]string{"ooni.io:path=~("}, uncensored.DefaultClient)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if proxy != nil {
+		t.Fatal("expected nil proxy here")
+	}
+}
+
+func TestRules(t *testing.T) {
+	proxy, err := NewCensoringProxy([]string{
+		"wikipedia.org:path=/wiki/Tiananmen",
+		":method=post:body=~falun\\s*gong",
+		"~^example\\.(com|org)$:query=q=antani",
+		":header=User-Agent=~^curl/",
+	}, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var upstream int
+	proxy.transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		upstream++
+		var body []byte
+		if req.Body != nil {
+			data, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			body = data
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		}, nil
+	})
+	tests := []struct {
+		name    string
+		method  string
+		url     string
+		headers map[string]string
+		body    string
+		blocked bool
+	}{{
+		name:    "path match",
+		method:  "GET",
+		url:     "http://zh.wikipedia.org/wiki/Tiananmen_Square",
+		blocked: true,
+	}, {
+		name:   "path mismatch",
+		method: "GET",
+		url:    "http://zh.wikipedia.org/wiki/Beijing",
+	}, {
+		name:    "body match",
+		method:  "POST",
+		url:     "http://www.example.net/",
+		body:    "the falun   gong movement",
+		blocked: true,
+	}, {
+		name:   "body match with wrong method",
+		method: "PUT",
+		url:    "http://www.example.net/",
+		body:   "the falun gong movement",
+	}, {
+		name:    "host regexp and query match",
+		method:  "GET",
+		url:     "http://example.org/search?q=antani",
+		blocked: true,
+	}, {
+		name:   "host regexp mismatch",
+		method: "GET",
+		url:    "http://www.example.org/search?q=antani",
+	}, {
+		name:    "header match",
+		method:  "GET",
+		url:     "http://www.example.net/",
+		headers: map[string]string{"User-Agent": "curl/7.64.1"},
+		blocked: true,
+	}, {
+		name:    "header mismatch",
+		method:  "GET",
+		url:     "http://www.example.net/",
+		headers: map[string]string{"User-Agent": "Mozilla/5.0"},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream = 0
+			req := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			w := httptest.NewRecorder()
+			proxy.ServeHTTP(w, req)
+			if tt.blocked {
+				if w.Code != 451 || upstream != 0 {
+					t.Fatal("expected the request to be blocked")
+				}
+				return
+			}
+			if w.Code != 200 || upstream != 1 {
+				t.Fatal("expected the request to be forwarded")
+			}
+			if w.Body.String() != tt.body {
+				t.Fatal("the proxy did not forward the whole body")
+			}
+		})
+	}
+}
+
+func TestBlockpageSelection(t *testing.T) {
+	proxy, err := NewCensoringProxy([]string{
+		"ooni.io:blockpage=redirect-302",
+		"ooni.nu:blockpage=antani",
+	}, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://mia-ps.ooni.io/", nil))
+	if w.Code != 302 || w.Header().Get("Location") == "" {
+		t.Fatal("expected a redirect")
+	}
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://hkgmetadb.ooni.nu/", nil))
+	if w.Code != 500 {
+		t.Fatal("expected an internal server error")
+	}
+	proxy.Blockpages["antani"], err = NewBlockpage("antani", "{{.Antani}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://hkgmetadb.ooni.nu/", nil))
+	if w.Code != 500 {
+		t.Fatal("expected an internal server error")
+	}
+}
+
+func TestStartUnknownBlockpage(t *testing.T) {
+	proxy, err := NewCensoringProxy([]string{"ooni.io:blockpage=antani"}, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, addr, err := proxy.Start("127.0.0.1:0")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if server != nil || addr != nil {
+		t.Fatal("expected nil server and addr here")
+	}
+}
+
+func TestTamperAction(t *testing.T) {
+	proxy, err := NewCensoringProxy([]string{
+		"ooni.io:inject=<p>injected</p>:delheader=Via",
+	}, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("Accept-Encoding") != "" {
+			return nil, errors.New("expected no Accept-Encoding")
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("<body></body>")),
+		}, nil
+	})
+	req := httptest.NewRequest("GET", "http://mia-ps.ooni.io/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatal("unexpected status code")
+	}
+	if w.Body.String() != "<body><p>injected</p></body>" {
+		t.Fatal("unexpected body")
+	}
+	if w.Header().Get("Via") != "" {
+		t.Fatal("expected no Via header")
+	}
+}
+
+func TestConnectionFailures(t *testing.T) {
+	proxy, err := NewCensoringProxy([]string{
+		"reset.example:reset",
+		"close.example:close",
+		"hang.example:hang",
+		"truncate.example:truncate=12",
+		"truncate.large.example:truncate=1000000",
+	}, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, addr, err := proxy.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer killproxy(t, server)
+	roundtrip := func(host string) ([]byte, error) {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(500 * time.Millisecond))
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", host)
+		return ioutil.ReadAll(conn)
+	}
+	if _, err := roundtrip("reset.example"); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatal("not the error we expected", err)
+	}
+	if data, err := roundtrip("close.example"); err != nil || len(data) != 0 {
+		t.Fatal("expected EOF without data")
+	}
+	var neterr net.Error
+	if _, err := roundtrip("hang.example"); !errors.As(err, &neterr) || !neterr.Timeout() {
+		t.Fatal("not the error we expected", err)
+	}
+	if data, err := roundtrip("truncate.example"); err != nil || string(data) != "HTTP/1.1 451" {
+		t.Fatal("unexpected truncated response")
+	}
+	resp, err := proxy.Blockpages[DefaultBlockpage].Render(
+		httptest.NewRequest("GET", "http://truncate.large.example/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var full bytes.Buffer
+	resp.Write(&full)
+	data, err := roundtrip("truncate.large.example")
+	if err != nil || !bytes.Equal(data, full.Bytes()[:full.Len()-1]) {
+		t.Fatal("expected all the response but the last byte")
+	}
+}
+
+func TestConnectionFailureWithoutHijacker(t *testing.T) {
+	proxy, err := NewCensoringProxy([]string{"ooni.io:reset"}, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		if recover() != http.ErrAbortHandler {
+			t.Fatal("expected the handler to abort")
+		}
+	}()
+	proxy.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://ooni.io/", nil))
+}
+
+func TestForwardProxy(t *testing.T) {
+	proxy, err := NewCensoringProxy([]string{"blocked.example"}, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.URL.String() != "http://allowed.example/antani?x=1" {
+			return nil, errors.New("unexpected URL")
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("hello")),
+		}, nil
+	})
+	server, addr, err := proxy.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer killproxy(t, server)
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "http", Host: addr.String()}),
+	}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get("http://allowed.example/antani?x=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != 200 || string(data) != "hello" {
+		t.Fatal("unexpected response")
+	}
+	resp, err = client.Get("http://blocked.example/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 451 {
+		t.Fatal("unexpected status code")
+	}
+}
+
+func TestConnect(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	proxy, err := NewCensoringProxy([]string{"blocked.example"}, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.dial = func(network, address string) (net.Conn, error) {
+		if address != "allowed.example:443" {
+			return nil, errors.New("unexpected address")
+		}
+		return net.Dial(network, echo.Addr().String())
+	}
+	server, addr, err := proxy.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer killproxy(t, server)
+	connect := func(target string) (*http.Response, net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nping", target, target)
+		reader := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, conn, reader
+	}
+	resp, conn, reader := connect("allowed.example:443")
+	defer conn.Close()
+	if resp.StatusCode != 200 {
+		t.Fatal("unexpected status code")
+	}
+	data := make([]byte, 4)
+	if _, err := io.ReadFull(reader, data); err != nil || string(data) != "ping" {
+		t.Fatal("unexpected echo")
+	}
+	resp, conn, _ = connect("blocked.example:443")
+	defer conn.Close()
+	if resp.StatusCode != 451 {
+		t.Fatal("unexpected status code")
+	}
+	resp, conn, _ = connect("failing.example:443")
+	defer conn.Close()
+	if resp.StatusCode != 502 {
+		t.Fatal("unexpected status code")
+	}
+}
+
+func TestOriginalDstFallback(t *testing.T) {
+	proxy, err := NewCensoringProxy(nil, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.OriginalDst = true
+	proxy.transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		// The connection has not been redirected, so we expect
+		// to use the Host header to choose the destination.
+		if req.URL.Host != "www.example.com" {
+			return nil, errors.New("unexpected URL host")
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	})
+	server, addr, err := proxy.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer killproxy(t, server)
+	req, err := http.NewRequest("GET", "http://"+addr.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "www.example.com"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatal("unexpected status code")
+	}
+}
+
+func TestH2C(t *testing.T) {
+	upstream := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.Proto))
+		}), &http2.Server{}))
+	defer upstream.Close()
+	proxy, err := NewCensoringProxy([]string{
+		"blocked.example",
+		"reset.example:reset",
+	}, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("expected to use h2c")
+	})
+	proxy.dial = func(network, address string) (net.Conn, error) {
+		return net.Dial(network, upstream.Listener.Addr().String())
+	}
+	proxy.ForwardH2C = true
+	server, addr, err := proxy.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer killproxy(t, server)
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, address string, config *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr.String())
+		},
+	}}
+	get := func(host string) (*http.Response, []byte, error) {
+		resp, err := client.Get("http://" + host + "/")
+		if err != nil {
+			return nil, nil, err
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		return resp, data, err
+	}
+	resp, data, err := get("allowed.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ProtoMajor != 2 || resp.StatusCode != 200 || string(data) != "HTTP/2.0" {
+		t.Fatal("unexpected response")
+	}
+	resp, _, err = get("blocked.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 451 {
+		t.Fatal("unexpected status code")
+	}
+	if _, _, err := get("reset.example"); err == nil {
+		t.Fatal("expected an error here")
+	}
+	// Resetting a stream does not affect the other streams
+	if _, _, err := get("allowed.example"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	proxy, err := NewCensoringProxy(nil, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, addr, err := proxy.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer killproxy(t, server)
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: www.example.com\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\n"+
+		"HTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal("unexpected status code")
+	}
+}
+
+func TestLoopDetection(t *testing.T) {
+	proxy, err := NewCensoringProxy(nil, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Use a transport resolving localhost using the system resolver
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	proxy.transport = transport
+	server, addr, err := proxy.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer killproxy(t, server)
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Here the destination is a domain, so the proxy connects to
+	// itself and then recognizes the connection it is using to forward
+	// the request. We expect the 400 to be forwarded, hence the Via.
+	checkrequest(t, addr.String(), net.JoinHostPort("localhost", port), 400, true)
+	// Requests already carrying a Via header are forwarded
+	req := httptest.NewRequest("GET", "http://www.example.com/", nil)
+	req.Header.Set("Via", "1.1 squid")
+	proxy.transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if values := req.Header.Values("Via"); len(values) != 2 || values[1] != product {
+			return nil, errors.New("unexpected Via header")
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	})
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatal("unexpected status code")
+	}
+}
+
+func TestLoopDetectionPipelinedConnect(t *testing.T) {
+	proxy, err := NewCensoringProxy(nil, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, errors.New("we should not forward the looping request")
+	})
+	server, addr, err := proxy.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer killproxy(t, server)
+	// The target is a domain resolving to the proxy itself. We give the
+	// proxy time to serve what we write before we return.
+	proxy.dial = func(network, address string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr.String())
+		if err != nil {
+			return nil, err
+		}
+		return &slowWriteConn{Conn: conn}, nil
+	}
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// The client sends the request right after CONNECT, so the proxy
+	// forwards it along with the reply to CONNECT.
+	_, err = conn.Write([]byte("CONNECT loop.example:80 HTTP/1.1\r\nHost: loop.example:80\r\n\r\n" +
+		"GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	for _, code := range []int{200, 400} {
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Fatalf("expected %d, got %d", code, resp.StatusCode)
+		}
+	}
+}
+
+func TestStealth(t *testing.T) {
+	proxy, err := NewCensoringProxy(nil, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.Stealth = true
+	proxy.transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("Via") != "" || req.Header.Get("X-Forwarded-For") != "" {
+			return nil, errors.New("unexpected headers")
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	})
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "http://www.example.com/", nil))
+	if w.Code != 200 {
+		t.Fatal("unexpected status code")
+	}
+	if w.Header().Get("Via") != "" {
+		t.Fatal("unexpected Via header")
+	}
+	// Check the headers a real upstream sees, even when the client
+	// sends its own X-Forwarded-For header.
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Via") != "" || r.Header.Get("X-Forwarded-For") != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer upstream.Close()
+	transport := &http.Transport{}
+	defer transport.CloseIdleConnections()
+	proxy.transport = transport
+	server, addr, err := proxy.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer killproxy(t, server)
+	req, err := http.NewRequest("GET", "http://"+addr.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = upstream.Listener.Addr().String()
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatal("unexpected headers upstream")
+	}
+}
+
 func newproxy(t *testing.T, blocked string) (*http.Server, net.Addr) {
-	proxy := NewCensoringProxy([]string{blocked}, uncensored.DefaultClient)
+	proxy, err := NewCensoringProxy([]string{blocked}, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
 	server, addr, err := proxy.Start("127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
@@ -128,3 +778,20 @@ func checkbody(t *testing.T, proxiedData []byte, host string) {
 		t.Fatal("body mismatch")
 	}
 }
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// slowWriteConn is a net.Conn that sleeps after each write.
+type slowWriteConn struct {
+	net.Conn
+}
+
+func (c *slowWriteConn) Write(b []byte) (int, error) {
+	count, err := c.Conn.Write(b)
+	time.Sleep(100 * time.Millisecond)
+	return count, err
+}
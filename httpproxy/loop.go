@@ -0,0 +1,90 @@
+package httpproxy
+
+import (
+	"context"
+	"net"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sockets tracks the local addresses of the connections we are using
+// to forward requests. If we receive a request from one of them, then
+// we are forwarding requests to ourselves.
+type sockets struct {
+	mu    sync.Mutex
+	inuse map[string]int
+}
+
+// add adds addr to the set of addresses in use.
+func (s *sockets) add(addr net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inuse == nil {
+		s.inuse = make(map[string]int)
+	}
+	s.inuse[addr.String()]++
+}
+
+// remove undoes add.
+func (s *sockets) remove(addr net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inuse[addr.String()]--; s.inuse[addr.String()] <= 0 {
+		delete(s.inuse, addr.String())
+	}
+}
+
+// has returns whether addr, in the format of http.Request.RemoteAddr,
+// is one of the addresses in use.
+func (s *sockets) has(addr string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inuse[addr] > 0
+}
+
+// trace returns a context that adds to s the local address of the
+// connections used to send requests with it, and a function removing
+// these addresses from s, to call when done with the request.
+func (s *sockets) trace(ctx context.Context) (context.Context, func()) {
+	var (
+		mu    sync.Mutex
+		addrs []net.Addr
+	)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			addr := info.Conn.LocalAddr()
+			s.add(addr)
+			mu.Lock()
+			addrs = append(addrs, addr)
+			mu.Unlock()
+		},
+	})
+	return ctx, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, addr := range addrs {
+			s.remove(addr)
+		}
+	}
+}
+
+// isself returns whether address, which is an IP address optionally
+// followed by a port (default: defaultPort), is the address where we
+// are listening. Domain names are handled by tracking sockets.
+func isself(listener net.Addr, address, defaultPort string) bool {
+	tcpAddr, ok := listener.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = strings.Trim(address, "[]"), defaultPort
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || port != strconv.Itoa(tcpAddr.Port) {
+		return false
+	}
+	return ip.Equal(tcpAddr.IP) || (tcpAddr.IP.IsUnspecified() && ip.IsLoopback())
+}
@@ -0,0 +1,44 @@
+package httpproxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSockets(t *testing.T) {
+	var s sockets
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 54321}
+	s.add(addr)
+	s.add(addr)
+	s.remove(addr)
+	if !s.has("127.0.0.1:54321") {
+		t.Fatal("expected the address to be in use")
+	}
+	s.remove(addr)
+	if s.has("127.0.0.1:54321") {
+		t.Fatal("expected the address not to be in use")
+	}
+}
+
+func TestIsSelf(t *testing.T) {
+	var inputs = []struct {
+		listener net.Addr
+		address  string
+		expect   bool
+	}{
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}, "127.0.0.1", true},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}, "127.0.0.1:80", true},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}, "127.0.0.1:8080", false},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}, "127.0.0.2", false},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}, "localhost", false},
+		{&net.TCPAddr{IP: net.IPv6zero, Port: 80}, "[::1]", true},
+		{&net.TCPAddr{IP: net.IPv4zero, Port: 80}, "127.0.0.1:80", true},
+		{&net.TCPAddr{IP: net.IPv4zero, Port: 80}, "8.8.8.8:80", false},
+		{nil, "127.0.0.1", false},
+	}
+	for _, input := range inputs {
+		if isself(input.listener, input.address, "80") != input.expect {
+			t.Fatalf("unexpected result for %+v", input)
+		}
+	}
+}
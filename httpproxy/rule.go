@@ -0,0 +1,260 @@
+package httpproxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ooni/jafar/internal/rulex"
+)
+
+const (
+	// ActionBlock is the action replying with the blockpage.
+	ActionBlock = "block"
+
+	// ActionTamper is the action forwarding the request and then
+	// modifying the response as described by the rule's Tamper.
+	ActionTamper = "tamper"
+
+	// ActionReset is the action resetting the connection.
+	ActionReset = "reset"
+
+	// ActionClose is the action closing the connection without
+	// sending any response.
+	ActionClose = "close"
+
+	// ActionHang is the action never answering.
+	ActionHang = "hang"
+
+	// ActionTruncate is the action sending the first Truncate bytes
+	// of the blockpage response and then closing the connection.
+	ActionTruncate = "truncate"
+)
+
+// Matcher matches strings. When Regexp is not nil, a string matches if
+// it matches Regexp. Otherwise, it matches if it contains Keyword.
+type Matcher struct {
+	Keyword string
+	Regexp  *regexp.Regexp
+}
+
+// NewMatcher creates a new Matcher. When s starts with `~`, the rest
+// of s is a regular expression. Otherwise, s is a keyword.
+func NewMatcher(s string) (*Matcher, error) {
+	if !strings.HasPrefix(s, "~") {
+		return &Matcher{Keyword: s}, nil
+	}
+	re, err := regexp.Compile(s[1:])
+	if err != nil {
+		return nil, err
+	}
+	return &Matcher{Regexp: re}, nil
+}
+
+// Match returns whether s matches.
+func (m *Matcher) Match(s string) bool {
+	if m.Regexp != nil {
+		return m.Regexp.MatchString(s)
+	}
+	return strings.Contains(s, m.Keyword)
+}
+
+// HeaderMatcher matches the values of the Name header.
+type HeaderMatcher struct {
+	Name string
+	*Matcher
+}
+
+// Rule is a censorship rule. The rule matches a request when all the
+// nonzero fields of the rule match the request. Action is the action
+// to perform when the rule matches.
+type Rule struct {
+	Host      *Matcher        // matches the Host header
+	Method    string          // matches the method (case insensitive)
+	Path      *Matcher        // matches the URL path
+	Query     *Matcher        // matches the raw URL query
+	Headers   []HeaderMatcher // match the request headers
+	Body      *Matcher        // matches the request body
+	Action    string          // what to do if the rule matches
+	Blockpage string          // name of the blockpage to use
+	Tamper    Tamper          // how to modify the response
+	Truncate  int             // bytes to send (zero means half)
+
+	text string // the rule as passed to ParseRule
+}
+
+// ParseRule parses a rule. The syntax is `host[:option...]` where host
+// matches the Host header, possibly empty to match any host, and the
+// options are the following:
+//
+// - `method=METHOD` matches the request method;
+//
+// - `path=PATTERN` matches the URL path;
+//
+// - `query=PATTERN` matches the raw URL query;
+//
+// - `header=NAME=PATTERN` matches the values of the NAME header;
+//
+// - `body=PATTERN` matches the request body;
+//
+// - `block` replies with the blockpage (this is the default action);
+//
+// - `blockpage=NAME` selects the blockpage (default: DefaultBlockpage);
+//
+// - `reset` resets the connection;
+//
+// - `close` closes the connection without sending any response;
+//
+// - `hang` never answers;
+//
+// - `truncate[=N]` sends the first N bytes of the blockpage response,
+// including status line and headers, and then closes the connection
+// (by default we send half of the response, and we never send the last
+// byte, even when N is larger than the response);
+//
+// - `tamper` forwards the request and modifies the response using the
+// following options, whose presence implies `tamper`;
+//
+// - `status=CODE` changes the status code;
+//
+// - `addheader=NAME=VALUE`, `setheader=NAME=VALUE`, and `delheader=NAME`
+// respectively add, set, and delete response headers;
+//
+// - `inject=TEXT` inserts TEXT before `</body>` or at the end;
+//
+// - `replace=PATTERN|TEXT` replaces what PATTERN matches with TEXT;
+//
+// - `setbody=TEXT` replaces the whole body with TEXT.
+//
+// The host and each PATTERN are keywords, unless they start with `~`,
+// in which case the rest is a regular expression (see NewMatcher). Wrap
+// a PATTERN, a VALUE, or a TEXT containing colons within square brackets.
+//
+// Before rules had options, the whole rule was the host keyword. Now
+// keywords starting with `~` or containing colons or square brackets
+// mean something else and need escaping: use `~~KEYWORD` to match a
+// KEYWORD starting with `~` and see package rulex for the brackets.
+func ParseRule(s string) (*Rule, error) {
+	parsed, err := rulex.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	rule := &Rule{Action: ActionBlock, Blockpage: DefaultBlockpage, text: s}
+	if rule.Host, err = NewMatcher(parsed.Pattern); err != nil {
+		return nil, err
+	}
+	var action string
+	for _, option := range parsed.Options {
+		tamper, err := rule.Tamper.parseOption(option.Name, option.Value)
+		if err != nil {
+			return nil, err
+		}
+		if tamper {
+			continue
+		}
+		switch option.Name {
+		case "method":
+			rule.Method = option.Value
+		case "path":
+			rule.Path, err = NewMatcher(option.Value)
+		case "query":
+			rule.Query, err = NewMatcher(option.Value)
+		case "header":
+			rule.Headers, err = appendHeaderMatcher(rule.Headers, option.Value)
+		case "body":
+			rule.Body, err = NewMatcher(option.Value)
+		case ActionBlock, ActionTamper, ActionReset, ActionClose,
+			ActionHang, ActionTruncate:
+			if action != "" && action != option.Name {
+				return nil, fmt.Errorf("httpproxy: conflicting actions in %q", s)
+			}
+			action = option.Name
+			if option.Name == ActionTruncate && option.Value != "" {
+				rule.Truncate, err = strconv.Atoi(option.Value)
+				if err == nil && rule.Truncate <= 0 {
+					err = fmt.Errorf("httpproxy: invalid truncate: %s", option.Value)
+				}
+			}
+		case "blockpage":
+			rule.Blockpage = option.Value
+		default:
+			err = rulex.Unknown(option)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	tampering := rule.Tamper.Status != 0 || rule.Tamper.Headers != nil ||
+		rule.Tamper.Body != nil
+	switch {
+	case action != "" && action != ActionTamper && tampering:
+		return nil, fmt.Errorf("httpproxy: tampering options in %s rule %q", action, s)
+	case action != "":
+		rule.Action = action
+	case tampering:
+		rule.Action = ActionTamper
+	}
+	return rule, nil
+}
+
+func appendHeaderMatcher(in []HeaderMatcher, s string) ([]HeaderMatcher, error) {
+	v := strings.SplitN(s, "=", 2)
+	if len(v) != 2 || v[0] == "" {
+		return nil, fmt.Errorf("httpproxy: invalid header matcher: %s", s)
+	}
+	matcher, err := NewMatcher(v[1])
+	if err != nil {
+		return nil, err
+	}
+	return append(in, HeaderMatcher{Name: v[0], Matcher: matcher}), nil
+}
+
+// ParseRules is like ParseRule but parses a list of rules.
+func ParseRules(in []string) ([]*Rule, error) {
+	var out []*Rule
+	for _, s := range in {
+		rule, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rule)
+	}
+	return out, nil
+}
+
+// match returns whether the rule matches r, whose body is body.
+func (rule *Rule) match(r *http.Request, body []byte) bool {
+	if !rule.Host.Match(r.Host) {
+		return false
+	}
+	if rule.Method != "" && !strings.EqualFold(rule.Method, r.Method) {
+		return false
+	}
+	if rule.Path != nil && !rule.Path.Match(r.URL.Path) {
+		return false
+	}
+	if rule.Query != nil && !rule.Query.Match(r.URL.RawQuery) {
+		return false
+	}
+	for _, header := range rule.Headers {
+		if !matchany(header.Matcher, r.Header.Values(header.Name)) {
+			return false
+		}
+	}
+	if rule.Body != nil && !rule.Body.Match(string(body)) {
+		return false
+	}
+	return true
+}
+
+// matchany returns whether any of the values matches.
+func matchany(m *Matcher, values []string) bool {
+	for _, value := range values {
+		if m.Match(value) {
+			return true
+		}
+	}
+	return false
+}
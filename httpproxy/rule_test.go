@@ -0,0 +1,106 @@
+package httpproxy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ooni/jafar/internal/rulex"
+)
+
+func TestNewMatcher(t *testing.T) {
+	keyword, err := NewMatcher("ooni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keyword.Match("www.ooni.org") || keyword.Match("www.example.com") {
+		t.Fatal("unexpected keyword matching")
+	}
+	re, err := NewMatcher("~^www\\.ooni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !re.Match("www.ooni.org") || re.Match("api.www.ooni.org") {
+		t.Fatal("unexpected regexp matching")
+	}
+	escaped, err := NewMatcher("~~ooni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !escaped.Match("www.~ooni.org") || escaped.Match("www.ooni.org") {
+		t.Fatal("unexpected escaped keyword matching")
+	}
+	if _, err := NewMatcher("~("); err == nil {
+		t.Fatal("expected an error here")
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	rule, err := ParseRule(
+		"ooni.io:method=GET:path=/wiki:query=~q=:header=Cookie=a=b:body=x:block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Host.Keyword != "ooni.io" || rule.Method != "GET" {
+		t.Fatal("unexpected host or method")
+	}
+	if rule.Path.Keyword != "/wiki" || rule.Query.Regexp.String() != "q=" {
+		t.Fatal("unexpected path or query")
+	}
+	if len(rule.Headers) != 1 || rule.Headers[0].Name != "Cookie" ||
+		rule.Headers[0].Keyword != "a=b" {
+		t.Fatal("unexpected headers")
+	}
+	if rule.Body.Keyword != "x" || rule.Action != ActionBlock {
+		t.Fatal("unexpected body or action")
+	}
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	for _, input := range []string{
+		"ooni.io:path=[",
+		"~(",
+		"ooni.io:path=~(",
+		"ooni.io:query=~(",
+		"ooni.io:header=Cookie",
+		"ooni.io:header==x",
+		"ooni.io:header=Cookie=~(",
+		"ooni.io:body=~(",
+		"ooni.io:truncate=0",
+		"ooni.io:truncate=x",
+		"ooni.io:reset:block",
+		"ooni.io:hang:status=200",
+	} {
+		if _, err := ParseRule(input); err == nil {
+			t.Fatalf("expected an error for %s", input)
+		}
+	}
+}
+
+func TestParseRuleConnectionFailures(t *testing.T) {
+	for _, action := range []string{ActionReset, ActionClose, ActionHang, ActionTruncate} {
+		rule, err := ParseRule("ooni.io:" + action)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rule.Action != action || rule.Truncate != 0 {
+			t.Fatal("unexpected action or truncate")
+		}
+	}
+	rule, err := ParseRule("ooni.io:truncate=100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Action != ActionTruncate || rule.Truncate != 100 {
+		t.Fatal("unexpected action or truncate")
+	}
+}
+
+func TestParseRulesUnknownOption(t *testing.T) {
+	rules, err := ParseRules([]string{"ooni.io", "ooni.io:antani"})
+	if !errors.Is(err, rulex.ErrUnknownOption) {
+		t.Fatal("not the error we expected")
+	}
+	if rules != nil {
+		t.Fatal("expected nil rules here")
+	}
+}
@@ -0,0 +1,130 @@
+package httpproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// bodyEnd matches `</body>` regardless of the case. Unlike lowercasing
+// the body, it does not change offsets when the body is not UTF-8.
+var bodyEnd = regexp.MustCompile("(?i)</body>")
+
+// HeaderEdit is an edit of the response headers. Op is one of "add",
+// "set", and "del". Value is ignored by "del".
+type HeaderEdit struct {
+	Op    string
+	Name  string
+	Value string
+}
+
+// BodyEdit is an edit of the response body. Op is one of "inject",
+// which inserts Text before `</body>` or at the end of the body if
+// there is no `</body>`, "replace", which replaces what Old matches
+// with Text, and "set", which replaces the whole body with Text.
+type BodyEdit struct {
+	Op   string
+	Old  *Matcher
+	Text string
+}
+
+// Tamper describes how the tamper action modifies responses.
+type Tamper struct {
+	Status  int          // new status code, if nonzero
+	Headers []HeaderEdit // edits applied in order to the headers
+	Body    []BodyEdit   // edits applied in order to the body
+}
+
+// parseOption parses a tamper option. It returns false if the option
+// is not a tamper option.
+func (t *Tamper) parseOption(name, value string) (bool, error) {
+	switch name {
+	case "status":
+		status, err := strconv.Atoi(value)
+		if err != nil || status < 100 || status > 999 {
+			return true, fmt.Errorf("httpproxy: invalid status: %s", value)
+		}
+		t.Status = status
+	case "addheader", "setheader":
+		v := strings.SplitN(value, "=", 2)
+		if len(v) != 2 || v[0] == "" {
+			return true, fmt.Errorf("httpproxy: invalid %s: %s", name, value)
+		}
+		t.Headers = append(t.Headers, HeaderEdit{
+			Op: strings.TrimSuffix(name, "header"), Name: v[0], Value: v[1],
+		})
+	case "delheader":
+		t.Headers = append(t.Headers, HeaderEdit{Op: "del", Name: value})
+	case "inject":
+		t.Body = append(t.Body, BodyEdit{Op: "inject", Text: value})
+	case "replace":
+		idx := strings.LastIndex(value, "|")
+		if idx < 0 {
+			return true, fmt.Errorf("httpproxy: invalid replace: %s", value)
+		}
+		old, err := NewMatcher(value[:idx])
+		if err != nil {
+			return true, err
+		}
+		t.Body = append(t.Body, BodyEdit{Op: "replace", Old: old, Text: value[idx+1:]})
+	case "setbody":
+		t.Body = append(t.Body, BodyEdit{Op: "set", Text: value})
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// apply modifies resp according to t.
+func (t *Tamper) apply(resp *http.Response) error {
+	if t.Status != 0 {
+		resp.StatusCode = t.Status
+		resp.Status = fmt.Sprintf("%d %s", t.Status, http.StatusText(t.Status))
+	}
+	for _, edit := range t.Headers {
+		switch edit.Op {
+		case "add":
+			resp.Header.Add(edit.Name, edit.Value)
+		case "set":
+			resp.Header.Set(edit.Name, edit.Value)
+		case "del":
+			resp.Header.Del(edit.Name)
+		}
+	}
+	if len(t.Body) <= 0 {
+		return nil
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	body := string(data)
+	for _, edit := range t.Body {
+		switch edit.Op {
+		case "inject":
+			idx := len(body)
+			if found := bodyEnd.FindAllStringIndex(body, -1); len(found) > 0 {
+				idx = found[len(found)-1][0]
+			}
+			body = body[:idx] + edit.Text + body[idx:]
+		case "replace":
+			if edit.Old.Regexp != nil {
+				body = edit.Old.Regexp.ReplaceAllString(body, edit.Text)
+			} else {
+				body = strings.ReplaceAll(body, edit.Old.Keyword, edit.Text)
+			}
+		case "set":
+			body = edit.Text
+		}
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader([]byte(body)))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.TransferEncoding = nil
+	return nil
+}
@@ -0,0 +1,152 @@
+package httpproxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTamperApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		body    string
+		status  int
+		headers http.Header
+		expect  string
+	}{{
+		name:   "inject before body end",
+		rule:   "ooni.io:inject=<script>alert(1)</script>",
+		body:   "<html><BODY>hello</BODY></html>",
+		status: 200,
+		expect: "<html><BODY>hello<script>alert(1)</script></BODY></html>",
+	}, {
+		name:   "inject at the end",
+		rule:   "ooni.io:inject=world",
+		body:   "hello, ",
+		status: 200,
+		expect: "hello, world",
+	}, {
+		name:   "inject into a body that is not UTF-8",
+		rule:   "ooni.io:inject=<p>x</p>",
+		body:   strings.Repeat("\xe9", 10) + "</BODY>",
+		status: 200,
+		expect: strings.Repeat("\xe9", 10) + "<p>x</p></BODY>",
+	}, {
+		name:   "inject text containing colons",
+		rule:   `ooni.io:inject=[<script src="http://evil.example/x.js"></script>]`,
+		body:   "<body></body>",
+		status: 200,
+		expect: `<body><script src="http://evil.example/x.js"></script></body>`,
+	}, {
+		name:   "replace keyword",
+		rule:   "ooni.io:replace=[https://|http://]",
+		body:   `<a href="https://ooni.org">ooni</a>`,
+		status: 200,
+		expect: `<a href="http://ooni.org">ooni</a>`,
+	}, {
+		name:   "replace regexp",
+		rule:   "ooni.io:replace=~(o+)ni|${1}NI",
+		body:   "ooni",
+		status: 200,
+		expect: "ooNI",
+	}, {
+		name:   "set body and status",
+		rule:   "ooni.io:setbody=swapped:status=403",
+		body:   "original",
+		status: 403,
+		expect: "swapped",
+	}, {
+		name:   "edit headers",
+		rule:   "ooni.io:delheader=Server:addheader=X-Antani=1:setheader=Content-Type=text/plain",
+		body:   "hello",
+		status: 200,
+		headers: http.Header{
+			"X-Antani":     []string{"0", "1"},
+			"Content-Type": []string{"text/plain"},
+		},
+		expect: "hello",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := ParseRule(tt.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rule.Action != ActionTamper {
+				t.Fatal("expected the tamper action")
+			}
+			resp := &http.Response{
+				StatusCode: 200,
+				Header: http.Header{
+					"Server":       []string{"nginx"},
+					"X-Antani":     []string{"0"},
+					"Content-Type": []string{"text/html"},
+				},
+				Body: ioutil.NopCloser(strings.NewReader(tt.body)),
+			}
+			if err := rule.Tamper.apply(resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatal("unexpected status code")
+			}
+			if tt.headers != nil {
+				for key, values := range tt.headers {
+					if strings.Join(resp.Header[key], ",") != strings.Join(values, ",") {
+						t.Fatalf("unexpected %s header", key)
+					}
+				}
+				if resp.Header.Get("Server") != "" {
+					t.Fatal("expected the Server header to be deleted")
+				}
+			}
+			data, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.expect {
+				t.Fatalf("unexpected body: %s", string(data))
+			}
+		})
+	}
+}
+
+func TestTamperReadError(t *testing.T) {
+	expected := errors.New("mocked error")
+	tamper := &Tamper{Body: []BodyEdit{{Op: "set", Text: "x"}}}
+	err := tamper.apply(&http.Response{
+		Header: http.Header{},
+		Body:   ioutil.NopCloser(&errorReader{err: expected}),
+	})
+	if !errors.Is(err, expected) {
+		t.Fatal("not the error we expected")
+	}
+}
+
+func TestParseRuleTamperErrors(t *testing.T) {
+	for _, input := range []string{
+		"ooni.io:status=antani",
+		"ooni.io:status=42",
+		"ooni.io:addheader=X-Antani",
+		"ooni.io:setheader==1",
+		"ooni.io:replace=antani",
+		"ooni.io:replace=~(|x",
+		"ooni.io:block:setbody=x",
+		"ooni.io:block:tamper",
+	} {
+		if _, err := ParseRule(input); err == nil {
+			t.Fatalf("expected an error for %s", input)
+		}
+	}
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,32 @@
+// Package origdst obtains the original destination of connections
+// redirected to us using iptables, e.g., by -iptables-hijack-http-to.
+package origdst
+
+import (
+	"errors"
+	"net"
+)
+
+// ErrNotTCP indicates that the connection is not a TCP connection.
+var ErrNotTCP = errors.New("origdst: not a TCP connection")
+
+// ErrNotRedirected indicates that the connection was not redirected.
+var ErrNotRedirected = errors.New("origdst: connection not redirected")
+
+// Get returns the original destination of conn, which must be a
+// connection we accepted. It fails when the connection has not been
+// redirected or the platform lacks support.
+func Get(conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, ErrNotTCP
+	}
+	addr, err := get(tc)
+	if err != nil {
+		return nil, err
+	}
+	if addr.String() == conn.LocalAddr().String() {
+		return nil, ErrNotRedirected
+	}
+	return addr, nil
+}
@@ -0,0 +1,66 @@
+// +build linux
+
+package origdst
+
+import (
+	"encoding/binary"
+	"net"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST, which has the same value as
+// IP6T_SO_ORIGINAL_DST, from <linux/netfilter_ipv4.h>.
+const soOriginalDst = 80
+
+func get(conn *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		addr  *net.TCPAddr
+		sverr error
+	)
+	// Implementation note: we cannot tell the family of the original
+	// destination from the local address, because IPv4 connections to
+	// a dual-stack socket have IPv4-mapped IPv6 local addresses. So, we
+	// try SOL_IP first, and fall back to SOL_IPV6 when it fails.
+	err = raw.Control(func(fd uintptr) {
+		// Implementation note: IPv6Mreq is large enough to contain
+		// a sockaddr_in, which is what the kernel returns.
+		var mreq *unix.IPv6Mreq
+		mreq, sverr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+		if sverr == nil {
+			addr = &net.TCPAddr{
+				IP:   net.IPv4(mreq.Multiaddr[4], mreq.Multiaddr[5], mreq.Multiaddr[6], mreq.Multiaddr[7]),
+				Port: int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4])),
+			}
+			return
+		}
+		// Implementation note: IPv6MTUInfo starts with a
+		// sockaddr_in6, which is what the kernel returns.
+		var info *unix.IPv6MTUInfo
+		info, sverr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+		if sverr == nil {
+			addr = &net.TCPAddr{
+				IP:   net.IP(info.Addr.Addr[:]),
+				Port: int(ntohs(&info.Addr.Port)),
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sverr != nil {
+		return nil, sverr
+	}
+	return addr, nil
+}
+
+// ntohs converts port, which is in network byte order, to host byte order.
+func ntohs(port *uint16) uint16 {
+	p := (*[2]byte)(unsafe.Pointer(port))
+	return uint16(p[0])<<8 | uint16(p[1])
+}
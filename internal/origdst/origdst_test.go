@@ -0,0 +1,44 @@
+package origdst
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestGetNotTCP(t *testing.T) {
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	addr, err := Get(conn)
+	if !errors.Is(err, ErrNotTCP) {
+		t.Fatal("not the error we expected")
+	}
+	if addr != nil {
+		t.Fatal("expected nil addr here")
+	}
+}
+
+func TestGetNotRedirected(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	clientconn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientconn.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	addr, err := Get(conn)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if addr != nil {
+		t.Fatal("expected nil addr here")
+	}
+}
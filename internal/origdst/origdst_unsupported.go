@@ -0,0 +1,12 @@
+// +build !linux
+
+package origdst
+
+import (
+	"errors"
+	"net"
+)
+
+func get(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errors.New("not implemented")
+}
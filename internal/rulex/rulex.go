@@ -0,0 +1,97 @@
+// Package rulex parses the censorship rules passed on the command line. A
+// rule is a pattern optionally followed by colon separated options, e.g.
+// `ooni.io`, `ooni.io:rst` or `ooni.io:ttl=300:addr=10.10.34.34`. Options
+// are either bare names or `name=value` pairs. Wrap the pattern or a value
+// within square brackets when it contains colons, e.g. `addr=[::1]`.
+//
+// This syntax breaks rules that used to be plain keywords. A keyword
+// containing colons or square brackets must now be wrapped within square
+// brackets, e.g. `[a:b]` for `a:b` and `[[a]]` for `[a]`, and a keyword
+// containing unbalanced brackets cannot be expressed.
+package rulex
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Option is an option of a rule.
+type Option struct {
+	Name  string // name of the option
+	Value string // value of the option or empty for bare options
+}
+
+// Rule is a parsed rule.
+type Rule struct {
+	Pattern string   // pattern triggering the rule
+	Options []Option // options in the order in which they appear
+}
+
+// Parse parses the rule contained in s.
+func Parse(s string) (*Rule, error) {
+	fields, err := split(s)
+	if err != nil {
+		return nil, err
+	}
+	rule := &Rule{Pattern: unbracket(fields[0])}
+	for _, field := range fields[1:] {
+		var option Option
+		if idx := strings.Index(field, "="); idx >= 0 {
+			option.Name, option.Value = field[:idx], unbracket(field[idx+1:])
+		} else {
+			option.Name = field
+		}
+		if option.Name == "" {
+			return nil, fmt.Errorf("rulex: empty option name in %q", s)
+		}
+		rule.Options = append(rule.Options, option)
+	}
+	return rule, nil
+}
+
+// split splits s at every colon that is not within square brackets.
+func split(s string) ([]string, error) {
+	var (
+		depth  int
+		fields []string
+		start  int
+	)
+	for idx, chr := range s {
+		switch chr {
+		case '[':
+			depth++
+		case ']':
+			if depth <= 0 {
+				return nil, fmt.Errorf("rulex: unbalanced brackets in %q", s)
+			}
+			depth--
+		case ':':
+			if depth == 0 {
+				fields = append(fields, s[start:idx])
+				start = idx + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("rulex: unbalanced brackets in %q", s)
+	}
+	return append(fields, s[start:]), nil
+}
+
+// unbracket removes the square brackets surrounding s, if any.
+func unbracket(s string) string {
+	if len(s) >= 2 && strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// ErrUnknownOption is the error returned by packages parsing the
+// options of a rule when they encounter an unknown option.
+var ErrUnknownOption = errors.New("rulex: unknown option")
+
+// Unknown returns an error wrapping ErrUnknownOption for option.
+func Unknown(option Option) error {
+	return fmt.Errorf("%w: %s", ErrUnknownOption, option.Name)
+}
@@ -0,0 +1,88 @@
+package rulex_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/ooni/jafar/internal/rulex"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		expect  *rulex.Rule
+		wantErr bool
+	}{{
+		name:   "keyword only",
+		input:  "ooni.io",
+		expect: &rulex.Rule{Pattern: "ooni.io"},
+	}, {
+		name:  "bare option",
+		input: "ooni.io:rst",
+		expect: &rulex.Rule{Pattern: "ooni.io", Options: []rulex.Option{
+			{Name: "rst"},
+		}},
+	}, {
+		name:  "options with values",
+		input: "ooni.io:ttl=300:addr=10.10.34.34:addr=[::1]:x=a=b",
+		expect: &rulex.Rule{Pattern: "ooni.io", Options: []rulex.Option{
+			{Name: "ttl", Value: "300"},
+			{Name: "addr", Value: "10.10.34.34"},
+			{Name: "addr", Value: "::1"},
+			{Name: "x", Value: "a=b"},
+		}},
+	}, {
+		name:   "bracketed pattern",
+		input:  "[example.com:8080]",
+		expect: &rulex.Rule{Pattern: "example.com:8080"},
+	}, {
+		name:   "escaped bracketed pattern",
+		input:  "[[a]]:rst",
+		expect: &rulex.Rule{Pattern: "[a]", Options: []rulex.Option{{Name: "rst"}}},
+	}, {
+		name:   "balanced brackets within pattern",
+		input:  "a[0]",
+		expect: &rulex.Rule{Pattern: "a[0]"},
+	}, {
+		name:  "empty pattern",
+		input: ":rst",
+		expect: &rulex.Rule{Options: []rulex.Option{
+			{Name: "rst"},
+		}},
+	}, {
+		name:    "unbalanced open bracket",
+		input:   "ooni.io:addr=[::1",
+		wantErr: true,
+	}, {
+		name:    "unbalanced close bracket",
+		input:   "ooni.io:addr=::1]",
+		wantErr: true,
+	}, {
+		name:    "empty option name",
+		input:   "ooni.io::rst",
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := rulex.Parse(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("rulex.Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.expect, rule); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestUnknown(t *testing.T) {
+	err := rulex.Unknown(rulex.Option{Name: "antani"})
+	if !errors.Is(err, rulex.ErrUnknownOption) {
+		t.Fatal("not the error we expected")
+	}
+	if err.Error() != "rulex: unknown option: antani" {
+		t.Fatal("unexpected error string")
+	}
+}
@@ -195,10 +195,13 @@ func TestIntegrationHijackDNS(t *testing.T) {
 	if runtime.GOOS != "linux" {
 		t.Skip("not implemented on this platform")
 	}
-	resolver := resolver.NewCensoringResolver(
+	resolver, err := resolver.NewCensoringResolver(
 		[]string{"ooni.io"}, nil, nil,
 		uncensored.Must(uncensored.NewClient("dot://1.1.1.1:853")),
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
 	server, err := resolver.Start("127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
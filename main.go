@@ -2,6 +2,7 @@
 package main
 
 import (
+	"crypto/x509"
 	"encoding/pem"
 	"errors"
 	"flag"
@@ -12,7 +13,9 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/apex/log/handlers/cli"
@@ -24,6 +27,7 @@ import (
 	"github.com/ooni/jafar/iptables"
 	"github.com/ooni/jafar/resolver"
 	"github.com/ooni/jafar/shellx"
+	"github.com/ooni/jafar/socksproxy"
 	"github.com/ooni/jafar/tlsproxy"
 	"github.com/ooni/jafar/uncensored"
 )
@@ -33,13 +37,25 @@ var (
 	badProxyAddressTLS  *string
 	badProxyTLSOutputCA *string
 
-	dnsProxyAddress *string
-	dnsProxyBlock   flagx.StringArray
-	dnsProxyHijack  flagx.StringArray
-	dnsProxyIgnore  flagx.StringArray
+	dnsProxyAddress      *string
+	dnsProxyBlock        flagx.StringArray
+	dnsProxyCacheTTL     *time.Duration
+	dnsProxyECS          *string
+	dnsProxyHijack       flagx.StringArray
+	dnsProxyIgnore       flagx.StringArray
+	dnsProxyTimeout      *time.Duration
+	dnsProxyTimeoutRcode *string
+	dnsProxyUDPSize      *uint
+	dnsProxyZone         *string
+	dnsProxyZoneFallback *bool
 
-	httpProxyAddress *string
-	httpProxyBlock   flagx.StringArray
+	httpProxyAddress    *string
+	httpProxyBlock      flagx.StringArray
+	httpProxyBlockpages *string
+	httpProxyDial       *string
+	httpProxyForwardH2C *bool
+	httpProxyHAR        *string
+	httpProxyStealth    *bool
 
 	iptablesDropIP          flagx.StringArray
 	iptablesDropKeywordHex  flagx.StringArray
@@ -55,8 +71,14 @@ var (
 	mainCommand *string
 	mainUser    *string
 
-	tlsProxyAddress *string
-	tlsProxyBlock   flagx.StringArray
+	socksProxyAddress *string
+	socksProxyBlock   flagx.StringArray
+
+	tlsProxyAddress      *string
+	tlsProxyBlock        flagx.StringArray
+	tlsProxyBlockpages   *string
+	tlsProxyDial         *string
+	tlsProxyMITMOutputCA *string
 
 	uncensoredResolverURL *string
 )
@@ -83,15 +105,43 @@ func init() {
 	)
 	flag.Var(
 		&dnsProxyBlock, "dns-proxy-block",
-		"Register keyword triggering NXDOMAIN censorship",
+		"Register rule triggering NXDOMAIN censorship",
+	)
+	dnsProxyCacheTTL = flag.Duration(
+		"dns-proxy-cache-ttl", 0,
+		"Maximum time for which to cache uncensored answers (zero disables caching)",
+	)
+	dnsProxyECS = flag.String(
+		"dns-proxy-ecs", "echo",
+		"EDNS Client Subnet policy: echo, strip, or a CIDR replacing the client's subnet",
 	)
 	flag.Var(
 		&dnsProxyHijack, "dns-proxy-hijack",
-		"Register keyword triggering redirection to 127.0.0.1",
+		"Register rule triggering redirection to 127.0.0.1 or to the rule's addresses",
 	)
 	flag.Var(
 		&dnsProxyIgnore, "dns-proxy-ignore",
-		"Register keyword causing the proxy to ignore the query",
+		"Register rule causing the proxy to ignore the query",
+	)
+	dnsProxyTimeout = flag.Duration(
+		"dns-proxy-timeout", 5*time.Second,
+		"Deadline for queries to the uncensored resolver (zero means no deadline)",
+	)
+	dnsProxyTimeoutRcode = flag.String(
+		"dns-proxy-timeout-rcode", "SERVFAIL",
+		"Rcode to reply with when the uncensored resolver times out",
+	)
+	dnsProxyUDPSize = flag.Uint(
+		"dns-proxy-udp-size", 1232,
+		"EDNS0 UDP payload size advertised by the DNS proxy (between 512 and 65535)",
+	)
+	dnsProxyZone = flag.String(
+		"dns-proxy-zone", "",
+		"Optional hosts or master file containing a static zone",
+	)
+	dnsProxyZoneFallback = flag.Bool(
+		"dns-proxy-zone-fallback", false,
+		"Resolve names not in the static zone using the uncensored resolver",
 	)
 
 	// httpProxy
@@ -101,7 +151,27 @@ func init() {
 	)
 	flag.Var(
 		&httpProxyBlock, "http-proxy-block",
-		"Register keyword triggering HTTP 451 censorship",
+		"Register rule triggering HTTP censorship",
+	)
+	httpProxyBlockpages = flag.String(
+		"http-proxy-blockpages", "",
+		"Optional directory containing additional *.tmpl blockpages",
+	)
+	httpProxyDial = flag.String(
+		"http-proxy-dial", "host",
+		"Where to forward redirected requests: host or origdst",
+	)
+	httpProxyForwardH2C = flag.Bool(
+		"http-proxy-forward-h2c", false,
+		"Forward requests received over h2c using h2c",
+	)
+	httpProxyHAR = flag.String(
+		"http-proxy-har", "",
+		"Optional file where to write the requests and responses in HAR format",
+	)
+	httpProxyStealth = flag.Bool(
+		"http-proxy-stealth", false,
+		"Do not add the Via and X-Forwarded-For headers",
 	)
 
 	// iptables
@@ -150,6 +220,16 @@ func init() {
 	mainCommand = flag.String("main-command", "", "Optional command to execute")
 	mainUser = flag.String("main-user", "nobody", "Run command as user")
 
+	// socksProxy
+	socksProxyAddress = flag.String(
+		"socks-proxy-address", "127.0.0.1:1080",
+		"Address where the SOCKS5 proxy should listen",
+	)
+	flag.Var(
+		&socksProxyBlock, "socks-proxy-block",
+		"Register rule triggering SOCKS5 censorship",
+	)
+
 	// tlsProxy
 	tlsProxyAddress = flag.String(
 		"tls-proxy-address", "127.0.0.1:443",
@@ -157,7 +237,19 @@ func init() {
 	)
 	flag.Var(
 		&tlsProxyBlock, "tls-proxy-block",
-		"Register keyword triggering TLS censorship",
+		"Register rule triggering TLS censorship",
+	)
+	tlsProxyBlockpages = flag.String(
+		"tls-proxy-blockpages", "",
+		"Optional directory containing additional *.tmpl blockpages for mitm rules",
+	)
+	tlsProxyDial = flag.String(
+		"tls-proxy-dial", "host",
+		"Where to forward redirected connections: host or origdst",
+	)
+	tlsProxyMITMOutputCA = flag.String(
+		"tls-proxy-mitm-output-ca", "tlsproxy.pem",
+		"File where to write the CA used by the TLS proxy mitm rules",
 	)
 
 	uncensoredResolverURL = flag.String(
@@ -177,28 +269,78 @@ func badProxyStartTLS() net.Listener {
 	proxy := badproxy.NewCensoringProxy()
 	listener, cert, err := proxy.StartTLS(*badProxyAddressTLS)
 	runtimex.PanicOnError(err, "proxy.StartTLS failed")
-	err = ioutil.WriteFile(*badProxyTLSOutputCA, pem.EncodeToMemory(&pem.Block{
+	writeCA(*badProxyTLSOutputCA, cert)
+	return listener
+}
+
+// writeCA writes the PEM encoding of cert into the file at path.
+func writeCA(path string, cert *x509.Certificate) {
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{
 		Type:  "CERTIFICATE",
 		Bytes: cert.Raw,
 	}), 0644)
 	runtimex.PanicOnError(err, "ioutil.WriteFile failed")
-	return listener
 }
 
 func dnsProxyStart(uncensored *uncensored.Client) *dns.Server {
-	proxy := resolver.NewCensoringResolver(
+	proxy, err := resolver.NewCensoringResolver(
 		dnsProxyBlock, dnsProxyHijack, dnsProxyIgnore, uncensored,
 	)
+	runtimex.PanicOnError(err, "resolver.NewCensoringResolver failed")
+	rcode, found := dns.StringToRcode[strings.ToUpper(*dnsProxyTimeoutRcode)]
+	if !found {
+		runtimex.PanicOnError(errors.New(*dnsProxyTimeoutRcode), "unknown rcode")
+	}
+	proxy.CacheTTL = *dnsProxyCacheTTL
+	proxy.Timeout = *dnsProxyTimeout
+	proxy.TimeoutRcode = rcode
+	if *dnsProxyUDPSize < 512 || *dnsProxyUDPSize > 65535 {
+		runtimex.PanicOnError(fmt.Errorf("%d", *dnsProxyUDPSize), "UDP size out of range")
+	}
+	proxy.UDPSize = uint16(*dnsProxyUDPSize)
+	switch *dnsProxyECS {
+	case "echo":
+	case "strip":
+		proxy.StripECS = true
+	default:
+		_, proxy.RewriteECS, err = net.ParseCIDR(*dnsProxyECS)
+		runtimex.PanicOnError(err, "net.ParseCIDR failed")
+	}
+	if *dnsProxyZone != "" {
+		proxy.Zone, err = resolver.LoadZone(*dnsProxyZone)
+		runtimex.PanicOnError(err, "resolver.LoadZone failed")
+		proxy.ZoneFallback = *dnsProxyZoneFallback
+	}
 	server, err := proxy.Start(*dnsProxyAddress)
 	runtimex.PanicOnError(err, "proxy.Start failed")
 	return server
 }
 
-func httpProxyStart(uncensored *uncensored.Client) *http.Server {
-	proxy := httpproxy.NewCensoringProxy(httpProxyBlock, uncensored)
+func httpProxyStart(uncensored *uncensored.Client) (*http.Server, *httpproxy.HARRecorder) {
+	proxy, err := httpproxy.NewCensoringProxy(httpProxyBlock, uncensored)
+	runtimex.PanicOnError(err, "httpproxy.NewCensoringProxy failed")
+	if *httpProxyBlockpages != "" {
+		err = proxy.Blockpages.Load(*httpProxyBlockpages)
+		runtimex.PanicOnError(err, "proxy.Blockpages.Load failed")
+	}
+	proxy.OriginalDst = originalDst(*httpProxyDial)
+	proxy.ForwardH2C = *httpProxyForwardH2C
+	proxy.Stealth = *httpProxyStealth
+	if *httpProxyHAR != "" {
+		proxy.HAR = httpproxy.NewHARRecorder()
+	}
 	server, _, err := proxy.Start(*httpProxyAddress)
 	runtimex.PanicOnError(err, "proxy.Start failed")
-	return server
+	return server, proxy.HAR
+}
+
+func httpProxyWriteHAR(recorder *httpproxy.HARRecorder) {
+	if recorder != nil {
+		err := recorder.WriteFile(*httpProxyHAR)
+		if err != nil {
+			log.WithError(err).Warn("recorder.WriteFile failed")
+		}
+	}
 }
 
 func iptablesStart() *iptables.CensoringPolicy {
@@ -219,13 +361,43 @@ func iptablesStart() *iptables.CensoringPolicy {
 	return policy
 }
 
+func socksProxyStart(uncensored *uncensored.Client) net.Listener {
+	proxy, err := socksproxy.NewCensoringProxy(socksProxyBlock, uncensored)
+	runtimex.PanicOnError(err, "socksproxy.NewCensoringProxy failed")
+	listener, err := proxy.Start(*socksProxyAddress)
+	runtimex.PanicOnError(err, "proxy.Start failed")
+	return listener
+}
+
 func tlsProxyStart(uncensored *uncensored.Client) net.Listener {
-	proxy := tlsproxy.NewCensoringProxy(tlsProxyBlock, uncensored)
+	proxy, err := tlsproxy.NewCensoringProxy(tlsProxyBlock, uncensored)
+	runtimex.PanicOnError(err, "tlsproxy.NewCensoringProxy failed")
+	if *tlsProxyBlockpages != "" {
+		err = proxy.Blockpages.Load(*tlsProxyBlockpages)
+		runtimex.PanicOnError(err, "proxy.Blockpages.Load failed")
+	}
+	proxy.OriginalDst = originalDst(*tlsProxyDial)
+	if proxy.CA != nil {
+		writeCA(*tlsProxyMITMOutputCA, proxy.CA)
+	}
 	listener, err := proxy.Start(*tlsProxyAddress)
 	runtimex.PanicOnError(err, "proxy.Start failed")
 	return listener
 }
 
+// originalDst returns whether the dial strategy is to connect
+// to the original destination of redirected connections.
+func originalDst(strategy string) bool {
+	switch strategy {
+	case "host":
+		return false
+	case "origdst":
+		return true
+	}
+	runtimex.PanicOnError(errors.New(strategy), "unknown dial strategy")
+	return false
+}
+
 func newUncensoredClient() *uncensored.Client {
 	clnt, err := uncensored.NewClient(*uncensoredResolverURL)
 	runtimex.PanicOnError(err, "uncensored.NewClient failed")
@@ -258,8 +430,10 @@ func main() {
 	defer badtlslistener.Close()
 	dnsproxy := dnsProxyStart(uncensoredClient)
 	defer dnsproxy.Shutdown()
-	httpproxy := httpProxyStart(uncensoredClient)
+	httpproxy, harRecorder := httpProxyStart(uncensoredClient)
 	defer httpproxy.Close()
+	sockslistener := socksProxyStart(uncensoredClient)
+	defer sockslistener.Close()
 	tlslistener := tlsProxyStart(uncensoredClient)
 	defer tlslistener.Close()
 	policy := iptablesStart()
@@ -272,5 +446,6 @@ func main() {
 		<-mainCh
 	}
 	policy.Waive()
+	httpProxyWriteHAR(harRecorder)
 	mustx(err, "subcommand failed", os.Exit)
 }
@@ -0,0 +1,68 @@
+package resolver
+
+import (
+	"sync"
+	"time"
+)
+
+// cacheEntry is an entry of the cache.
+type cacheEntry struct {
+	addrs   []string
+	expires time.Time
+	stored  time.Time
+	ttl     time.Duration
+}
+
+// cache caches the answers of the uncensored resolver.
+type cache struct {
+	entries map[string]cacheEntry
+	mu      sync.Mutex
+	now     func() time.Time
+}
+
+// newCache creates a new, empty cache.
+func newCache() *cache {
+	return &cache{entries: make(map[string]cacheEntry), now: time.Now}
+}
+
+// get returns the cached addresses for name along with their remaining
+// TTL in seconds. The boolean is false when there is no valid entry.
+func (c *cache) get(name string) ([]string, uint32, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, found := c.entries[name]
+	if !found {
+		return nil, 0, false
+	}
+	now := c.now()
+	if !entry.expires.After(now) {
+		delete(c.entries, name)
+		return nil, 0, false
+	}
+	remaining := entry.ttl - now.Sub(entry.stored)
+	return entry.addrs, uint32(remaining / time.Second), true
+}
+
+// put caches addrs for name, whose TTL is ttl, for ttl but at most for
+// maxAge. A nonpositive ttl or maxAge means that addrs should not be
+// cached at all.
+func (c *cache) put(name string, addrs []string, ttl, maxAge time.Duration) {
+	if ttl <= 0 || maxAge <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for key, entry := range c.entries {
+		if !entry.expires.After(now) {
+			delete(c.entries, key)
+		}
+	}
+	age := ttl
+	if age > maxAge {
+		age = maxAge
+	}
+	c.entries[name] = cacheEntry{
+		addrs: addrs, expires: now.Add(age), stored: now, ttl: ttl,
+	}
+}
@@ -0,0 +1,77 @@
+package resolver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCache(t *testing.T) {
+	now := time.Now()
+	c := newCache()
+	c.now = func() time.Time {
+		return now
+	}
+	if _, _, found := c.get("example.com."); found {
+		t.Fatal("unexpected cache hit")
+	}
+	c.put("example.com.", []string{"93.184.216.34"}, 60*time.Second, time.Hour)
+	c.put("example.org.", []string{"93.184.216.35"}, 0, time.Hour)
+	now = now.Add(15 * time.Second)
+	addrs, ttl, found := c.get("example.com.")
+	if !found {
+		t.Fatal("expected a cache hit")
+	}
+	if diff := cmp.Diff([]string{"93.184.216.34"}, addrs); diff != "" {
+		t.Fatal(diff)
+	}
+	if ttl != 45 {
+		t.Fatal("unexpected ttl")
+	}
+	if _, _, found := c.get("example.org."); found {
+		t.Fatal("zero ttl entries should not be cached")
+	}
+	now = now.Add(45 * time.Second)
+	if _, _, found := c.get("example.com."); found {
+		t.Fatal("unexpected cache hit after expiry")
+	}
+	if len(c.entries) != 0 {
+		t.Fatal("expired entry was not removed")
+	}
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	now := time.Now()
+	c := newCache()
+	c.now = func() time.Time {
+		return now
+	}
+	c.put("example.com.", []string{"93.184.216.34"}, 300*time.Second, 60*time.Second)
+	c.put("example.org.", []string{"93.184.216.35"}, 300*time.Second, 0)
+	now = now.Add(15 * time.Second)
+	if _, ttl, found := c.get("example.com."); !found || ttl != 285 {
+		t.Fatal("expected a cache hit with decremented ttl")
+	}
+	if _, _, found := c.get("example.org."); found {
+		t.Fatal("zero max age entries should not be cached")
+	}
+	now = now.Add(45 * time.Second)
+	if _, _, found := c.get("example.com."); found {
+		t.Fatal("unexpected cache hit after max age")
+	}
+}
+
+func TestCachePutRemovesExpired(t *testing.T) {
+	now := time.Now()
+	c := newCache()
+	c.now = func() time.Time {
+		return now
+	}
+	c.put("example.com.", []string{"93.184.216.34"}, time.Second, time.Hour)
+	now = now.Add(time.Second)
+	c.put("example.org.", []string{"93.184.216.35"}, time.Second, time.Hour)
+	if len(c.entries) != 1 {
+		t.Fatal("expired entry was not removed")
+	}
+}
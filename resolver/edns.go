@@ -0,0 +1,88 @@
+package resolver
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// defaultUDPSize is the default EDNS0 UDP payload size we advertise. We
+// use the value recommended by the DNS flag day 2020.
+const defaultUDPSize = 1232
+
+// write writes the reply m to req. If the client uses EDNS0, we add our
+// own OPT record to m. If rule is not nil, we also add to the OPT record
+// the bogus options of rule, even if the client does not use EDNS0. When
+// the reply goes over UDP, we truncate it to fit the client's buffer.
+func (r *CensoringResolver) write(
+	rw dns.ResponseWriter, req, m *dns.Msg, rule *Rule,
+) {
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil {
+		if int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+		reply := r.newopt()
+		if opt.Version() != 0 {
+			m.Answer, m.Ns, m.Extra = nil, nil, nil
+			m.Rcode = dns.RcodeBadVers
+		}
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				if ecs := r.ecs(subnet); ecs != nil {
+					reply.Option = append(reply.Option, ecs)
+				}
+			}
+		}
+		m.Extra = append(m.Extra, reply)
+	}
+	if rule != nil && len(rule.EDNSOptions) > 0 {
+		reply := m.IsEdns0()
+		if reply == nil {
+			reply = r.newopt()
+			m.Extra = append(m.Extra, reply)
+		}
+		reply.Option = append(reply.Option, rule.EDNSOptions...)
+	}
+	if _, udp := rw.RemoteAddr().(*net.UDPAddr); udp {
+		m.Truncate(size)
+	}
+	rw.WriteMsg(m)
+}
+
+// newopt creates the OPT record we include in replies.
+func (r *CensoringResolver) newopt() *dns.OPT {
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.SetUDPSize(r.UDPSize)
+	return opt
+}
+
+// ecs returns the EDNS Client Subnet option to include in the reply
+// given the option sent by the client, or nil to omit it. We always
+// set the scope to zero, since our answers do not depend on it.
+func (r *CensoringResolver) ecs(in *dns.EDNS0_SUBNET) *dns.EDNS0_SUBNET {
+	if r.StripECS {
+		return nil
+	}
+	out := *in
+	out.SourceScope = 0
+	if r.RewriteECS != nil {
+		out = *newsubnet(r.RewriteECS)
+	}
+	return &out
+}
+
+// newsubnet creates an EDNS Client Subnet option for ipnet.
+func newsubnet(ipnet *net.IPNet) *dns.EDNS0_SUBNET {
+	ones, _ := ipnet.Mask.Size()
+	subnet := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        2,
+		SourceNetmask: uint8(ones),
+		Address:       ipnet.IP,
+	}
+	if ip4 := ipnet.IP.To4(); ip4 != nil {
+		subnet.Family, subnet.Address = 1, ip4
+	}
+	return subnet
+}
@@ -0,0 +1,188 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+	"github.com/ooni/jafar/uncensored"
+)
+
+func newednsquery(name string, udpsize uint16, options ...dns.EDNS0) *dns.Msg {
+	query := newquery(name)
+	query.SetEdns0(udpsize, false)
+	opt := query.IsEdns0()
+	opt.Option = append(opt.Option, options...)
+	return query
+}
+
+func newednsresolver(t *testing.T, hijacked ...string) *CensoringResolver {
+	resolver, err := NewCensoringResolver(
+		nil, hijacked, nil, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resolver
+}
+
+func TestEDNSNegotiation(t *testing.T) {
+	resolver := newednsresolver(t, "ooni.io")
+	rw := &capturingResponseWriter{}
+	resolver.ServeDNS(rw, newednsquery("mia-ps.ooni.io", 4096))
+	opt := rw.msg.IsEdns0()
+	if opt == nil {
+		t.Fatal("expected an OPT record")
+	}
+	if opt.UDPSize() != defaultUDPSize || opt.Version() != 0 {
+		t.Fatal("unexpected OPT record")
+	}
+	rw = &capturingResponseWriter{}
+	resolver.ServeDNS(rw, newquery("mia-ps.ooni.io"))
+	if rw.msg.IsEdns0() != nil {
+		t.Fatal("did not expect an OPT record")
+	}
+}
+
+func TestEDNSBadVersion(t *testing.T) {
+	resolver := newednsresolver(t, "ooni.io")
+	query := newednsquery("mia-ps.ooni.io", 4096)
+	query.IsEdns0().SetVersion(1)
+	rw := &capturingResponseWriter{}
+	resolver.ServeDNS(rw, query)
+	if rw.msg.Rcode != dns.RcodeBadVers {
+		t.Fatal("unexpected rcode")
+	}
+	if len(rw.msg.Answer) != 0 || rw.msg.IsEdns0() == nil {
+		t.Fatal("unexpected reply")
+	}
+	if _, err := rw.msg.Pack(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEDNSClientSubnet(t *testing.T) {
+	client := newsubnet(&net.IPNet{
+		IP:   net.IPv4(192, 0, 2, 0).To4(),
+		Mask: net.CIDRMask(24, 32),
+	})
+	client.SourceScope = 24
+	_, rewrite, err := net.ParseCIDR("2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		strip   bool
+		rewrite *net.IPNet
+		expect  []dns.EDNS0
+	}{{
+		name: "echo",
+		expect: []dns.EDNS0{&dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: 24,
+			Address:       net.IPv4(192, 0, 2, 0).To4(),
+		}},
+	}, {
+		name:  "strip",
+		strip: true,
+	}, {
+		name:    "rewrite",
+		rewrite: rewrite,
+		expect: []dns.EDNS0{&dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        2,
+			SourceNetmask: 32,
+			Address:       rewrite.IP,
+		}},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver := newednsresolver(t, "ooni.io")
+			resolver.StripECS = tt.strip
+			resolver.RewriteECS = tt.rewrite
+			rw := &capturingResponseWriter{}
+			resolver.ServeDNS(rw, newednsquery("mia-ps.ooni.io", 4096, client))
+			if diff := cmp.Diff(tt.expect, rw.msg.IsEdns0().Option); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestEDNSBogusOptions(t *testing.T) {
+	resolver := newednsresolver(t, "ooni.io:ednsopt=65001/deadbeef")
+	rw := &capturingResponseWriter{}
+	resolver.ServeDNS(rw, newquery("mia-ps.ooni.io"))
+	opt := rw.msg.IsEdns0()
+	if opt == nil {
+		t.Fatal("expected an OPT record")
+	}
+	expect := []dns.EDNS0{&dns.EDNS0_LOCAL{
+		Code: 65001,
+		Data: []byte{0xde, 0xad, 0xbe, 0xef},
+	}}
+	if diff := cmp.Diff(expect, opt.Option); diff != "" {
+		t.Fatal(diff)
+	}
+	rw = &capturingResponseWriter{}
+	resolver.ServeDNS(rw, newednsquery("mia-ps.ooni.io", 4096))
+	if diff := cmp.Diff(expect, rw.msg.IsEdns0().Option); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestEDNSTruncation(t *testing.T) {
+	hijack := "ooni.io"
+	for i := 1; i <= 64; i++ {
+		hijack += fmt.Sprintf(":addr=10.0.0.%d", i)
+	}
+	resolver := newednsresolver(t, hijack)
+	tests := []struct {
+		name      string
+		query     *dns.Msg
+		remote    net.Addr
+		truncated bool
+	}{{
+		name:      "UDP without EDNS0",
+		query:     newquery("mia-ps.ooni.io"),
+		remote:    &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		truncated: true,
+	}, {
+		name:      "UDP with small EDNS0 buffer",
+		query:     newednsquery("mia-ps.ooni.io", 600),
+		remote:    &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		truncated: true,
+	}, {
+		name:   "UDP with large EDNS0 buffer",
+		query:  newednsquery("mia-ps.ooni.io", 4096),
+		remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)},
+	}, {
+		name:   "TCP",
+		query:  newquery("mia-ps.ooni.io"),
+		remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := &capturingResponseWriter{remote: tt.remote}
+			resolver.ServeDNS(rw, tt.query)
+			if rw.msg.Truncated != tt.truncated {
+				t.Fatal("unexpected truncated flag")
+			}
+			if !tt.truncated && len(rw.msg.Answer) != 64 {
+				t.Fatal("unexpected number of answers")
+			}
+			if tt.truncated {
+				size := dns.MinMsgSize
+				if opt := tt.query.IsEdns0(); opt != nil {
+					size = int(opt.UDPSize())
+				}
+				if rw.msg.Len() > size {
+					t.Fatal("reply does not fit the client's buffer")
+				}
+			}
+		})
+	}
+}
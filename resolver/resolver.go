@@ -3,8 +3,11 @@ package resolver
 
 import (
 	"context"
+	"errors"
+	"math"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/ooni/probe-engine/netx/httptransport"
@@ -12,32 +15,103 @@ import (
 
 // CensoringResolver is a censoring resolver.
 type CensoringResolver struct {
-	blocked    []string
-	hijacked   []string
-	ignored    []string
+	// CacheTTL is the maximum time for which we cache the answers of
+	// the uncensored resolver, which we otherwise cache according to
+	// their TTL, when the uncensored resolver tells us (see Exchanger).
+	// We do not cache anything when it's zero.
+	CacheTTL time.Duration
+
+	// Timeout is the deadline of each query sent to the uncensored
+	// resolver. There is no deadline when it's zero.
+	Timeout time.Duration
+
+	// TimeoutRcode is the rcode we reply with when the uncensored
+	// resolver times out. NewCensoringResolver sets it to SERVFAIL.
+	TimeoutRcode int
+
+	// Zone is an optional static zone for which we are authoritative.
+	Zone *Zone
+
+	// ZoneFallback indicates whether to use the uncensored resolver
+	// for the names that are not in Zone. When it's false, we reply
+	// with NXDOMAIN to queries for names not in Zone.
+	ZoneFallback bool
+
+	// UDPSize is the EDNS0 UDP payload size we advertise in replies
+	// to EDNS0 queries. NewCensoringResolver sets it to 1232.
+	UDPSize uint16
+
+	// StripECS indicates whether to omit the EDNS Client Subnet option
+	// from replies. Otherwise, we echo the client's option.
+	StripECS bool
+
+	// RewriteECS, if not nil, replaces the subnet of the EDNS Client
+	// Subnet option we echo in replies.
+	RewriteECS *net.IPNet
+
+	blocked    []*Rule
+	cache      *cache
+	exchange   func(ctx context.Context, query *dns.Msg) (*dns.Msg, error)
+	hijacked   []*Rule
+	ignored    []*Rule
 	lookupHost func(ctx context.Context, host string) ([]string, error)
 }
 
+// Exchanger is an uncensored resolver that can also exchange DNS
+// messages, which tell us the TTLs of the answers. Without it, we
+// cache answers for CensoringResolver.CacheTTL.
+type Exchanger interface {
+	CanExchange() bool
+	Exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error)
+}
+
+// errNoAddresses indicates that the uncensored resolver did not
+// return any address.
+var errNoAddresses = errors.New("resolver: no addresses")
+
 // NewCensoringResolver creates a new CensoringResolver instance using
-// the specified list of keywords to censor. blocked is the list of
-// keywords that trigger NXDOMAIN if they appear in a query. hijacked
-// is similar but redirects to 127.0.0.1, where the transparent HTTP
-// and TLS proxies will pick them up. dnsNetwork and dnsAddress are the
-// settings to configure the upstream, non censored DNS.
+// the specified lists of rules (see ParseRule). blocked is the list of
+// rules that trigger NXDOMAIN if they match a query. hijacked is similar
+// but by default redirects to 127.0.0.1, where the transparent HTTP and
+// TLS proxies will pick them up. ignored is similar but causes the query
+// to be ignored. uncensored is the upstream, non censored DNS.
 func NewCensoringResolver(
 	blocked, hijacked, ignored []string, uncensored httptransport.Resolver,
-) *CensoringResolver {
-	return &CensoringResolver{
-		blocked:    blocked,
-		hijacked:   hijacked,
-		ignored:    ignored,
-		lookupHost: uncensored.LookupHost,
+) (*CensoringResolver, error) {
+	blockedRules, err := parseRulesWithout(blocked, "block", hijackOptions)
+	if err != nil {
+		return nil, err
+	}
+	hijackedRules, err := ParseRules(hijacked)
+	if err != nil {
+		return nil, err
+	}
+	ignoredRules, err := parseRulesWithout(ignored, "ignore", hijackOptions, replyOptions)
+	if err != nil {
+		return nil, err
+	}
+	r := &CensoringResolver{
+		TimeoutRcode: dns.RcodeServerFailure,
+		UDPSize:      defaultUDPSize,
+		blocked:      blockedRules,
+		cache:        newCache(),
+		hijacked:     hijackedRules,
+		ignored:      ignoredRules,
+		lookupHost:   uncensored.LookupHost,
 	}
+	if exchanger, ok := uncensored.(Exchanger); ok && exchanger.CanExchange() {
+		r.exchange = exchanger.Exchange
+	}
+	return r, nil
 }
 
 func (r *CensoringResolver) roundtrip(rw dns.ResponseWriter, req *dns.Msg) {
 	name := req.Question[0].Name
-	addrs, err := r.lookupHost(context.Background(), name)
+	addrs, ttl, err := r.lookup(name)
+	if err == context.DeadlineExceeded {
+		r.failure(rw, req, r.TimeoutRcode)
+		return
+	}
 	var ips []net.IP
 	if err == nil {
 		for _, addr := range addrs {
@@ -46,71 +120,251 @@ func (r *CensoringResolver) roundtrip(rw dns.ResponseWriter, req *dns.Msg) {
 			}
 		}
 	}
-	r.reply(rw, req, ips)
+	r.reply(rw, req, ips, ttl, nil)
+}
+
+// lookup resolves name using the cache or the uncensored resolver. On
+// success, it returns the addresses and their TTL in seconds. When the
+// uncensored resolver does not answer before r.Timeout, the returned
+// error is context.DeadlineExceeded, even if the lookup ignores the
+// context.
+func (r *CensoringResolver) lookup(name string) ([]string, uint32, error) {
+	if addrs, ttl, found := r.cache.get(name); found {
+		return addrs, ttl, nil
+	}
+	ctx := context.Background()
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	type result struct {
+		addrs []string
+		ttl   time.Duration
+		err   error
+	}
+	ch := make(chan result, 1) // buffer so the goroutine won't leak
+	go func() {
+		addrs, ttl, err := r.lookupTTL(ctx, name)
+		ch <- result{addrs: addrs, ttl: ttl, err: err}
+	}()
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			if ctx.Err() != nil {
+				return nil, 0, ctx.Err()
+			}
+			return nil, 0, res.err
+		}
+		r.cache.put(name, res.addrs, res.ttl, r.CacheTTL)
+		return res.addrs, uint32(res.ttl / time.Second), nil
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	}
+}
+
+// lookupTTL resolves name using the uncensored resolver and returns the
+// addresses and the minimum TTL of the answers. When the uncensored
+// resolver does not tell us the TTL, we use r.CacheTTL instead.
+func (r *CensoringResolver) lookupTTL(
+	ctx context.Context, name string,
+) ([]string, time.Duration, error) {
+	if r.exchange == nil {
+		addrs, err := r.lookupHost(ctx, name)
+		return addrs, r.CacheTTL, err
+	}
+	var (
+		addrs  []string
+		errlst error
+		ttl    uint32 = math.MaxUint32
+	)
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		query := new(dns.Msg)
+		query.SetQuestion(dns.Fqdn(name), qtype)
+		reply, err := r.exchange(ctx, query)
+		if err != nil {
+			errlst = err
+			continue
+		}
+		for _, rr := range reply.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, rr.A.String())
+			case *dns.AAAA:
+				addrs = append(addrs, rr.AAAA.String())
+			}
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+	}
+	if len(addrs) <= 0 {
+		if errlst == nil {
+			errlst = errNoAddresses
+		}
+		return nil, 0, errlst
+	}
+	return addrs, time.Duration(ttl) * time.Second, nil
 }
 
 func (r *CensoringResolver) reply(
-	rw dns.ResponseWriter, req *dns.Msg, ips []net.IP,
+	rw dns.ResponseWriter, req *dns.Msg, ips []net.IP, ttl uint32, rule *Rule,
+) {
+	m := newreply(req)
+	m.Answer = addresses(req.Question[0].Name, req.Question[0].Qtype, ips, ttl)
+	if m.Answer == nil {
+		m.SetRcode(req, dns.RcodeNameError)
+	}
+	r.write(rw, req, m, rule)
+}
+
+// hijack replies to req using the records described by rule.
+func (r *CensoringResolver) hijack(
+	rw dns.ResponseWriter, req *dns.Msg, rule *Rule,
+) {
+	m := newreply(req)
+	owner := req.Question[0].Name
+	for _, cname := range rule.CNAMEs {
+		m.Answer = append(m.Answer, &dns.CNAME{
+			Hdr:    header(owner, dns.TypeCNAME, rule.TTL),
+			Target: cname,
+		})
+		owner = cname
+	}
+	m.Answer = append(m.Answer, addresses(
+		owner, req.Question[0].Qtype, rule.Addresses, rule.TTL)...)
+	if m.Answer == nil {
+		m.SetRcode(req, dns.RcodeNameError)
+	}
+	for _, ns := range rule.nameservers(owner) {
+		if rule.Authority {
+			m.Ns = append(m.Ns, &dns.NS{
+				Hdr: header(owner, dns.TypeNS, rule.TTL),
+				Ns:  ns,
+			})
+		}
+		if rule.Additional {
+			m.Extra = append(m.Extra, addresses(
+				ns, dns.TypeA, rule.Glue, rule.TTL)...)
+			m.Extra = append(m.Extra, addresses(
+				ns, dns.TypeAAAA, rule.Glue, rule.TTL)...)
+		}
+	}
+	r.write(rw, req, m, rule)
+}
+
+// authoritative replies to req using the records of r.Zone.
+func (r *CensoringResolver) authoritative(
+	rw dns.ResponseWriter, req *dns.Msg, answer []dns.RR, found bool,
 ) {
+	m := newreply(req)
+	m.Authoritative = true
+	m.Answer = answer
+	if !found {
+		m.SetRcode(req, dns.RcodeNameError)
+	}
+	if soa := r.Zone.soa(req.Question[0].Name); soa != nil && answer == nil {
+		m.Ns = append(m.Ns, soa)
+	}
+	r.write(rw, req, m, nil)
+}
+
+// newreply creates a new reply for req.
+func newreply(req *dns.Msg) *dns.Msg {
 	m := new(dns.Msg)
 	m.Compress = true
 	m.MsgHdr.RecursionAvailable = true
 	m.SetReply(req)
+	return m
+}
+
+// header returns the header of a record of class IN.
+func header(name string, rrtype uint16, ttl uint32) dns.RR_Header {
+	return dns.RR_Header{
+		Name:   name,
+		Rrtype: rrtype,
+		Class:  dns.ClassINET,
+		Ttl:    ttl,
+	}
+}
+
+// addresses returns the A or AAAA records for name, depending on
+// qtype, using the addresses in ips of the matching family.
+func addresses(name string, qtype uint16, ips []net.IP, ttl uint32) []dns.RR {
+	var out []dns.RR
 	for _, ip := range ips {
 		ipv6 := strings.Contains(ip.String(), ":")
-		if !ipv6 && req.Question[0].Qtype == dns.TypeA {
-			m.Answer = append(m.Answer, &dns.A{
-				Hdr: dns.RR_Header{
-					Name:   req.Question[0].Name,
-					Rrtype: dns.TypeA,
-					Class:  dns.ClassINET,
-					Ttl:    0,
-				},
-				A: ip,
+		switch {
+		case !ipv6 && qtype == dns.TypeA:
+			out = append(out, &dns.A{
+				Hdr: header(name, dns.TypeA, ttl),
+				A:   ip,
+			})
+		case ipv6 && qtype == dns.TypeAAAA:
+			out = append(out, &dns.AAAA{
+				Hdr:  header(name, dns.TypeAAAA, ttl),
+				AAAA: ip,
 			})
 		}
 	}
-	if m.Answer == nil {
-		m.SetRcode(req, dns.RcodeNameError)
-	}
-	rw.WriteMsg(m)
+	return out
 }
 
-func (r *CensoringResolver) failure(rw dns.ResponseWriter, req *dns.Msg) {
+func (r *CensoringResolver) failure(rw dns.ResponseWriter, req *dns.Msg, rcode int) {
 	m := new(dns.Msg)
 	m.Compress = true
 	m.MsgHdr.RecursionAvailable = true
-	m.SetRcode(req, dns.RcodeServerFailure)
-	rw.WriteMsg(m)
+	m.SetRcode(req, rcode)
+	r.write(rw, req, m, nil)
 }
 
 // ServeDNS serves a DNS request
 func (r *CensoringResolver) ServeDNS(rw dns.ResponseWriter, req *dns.Msg) {
 	if len(req.Question) < 1 {
-		r.failure(rw, req)
+		r.failure(rw, req, dns.RcodeServerFailure)
 		return
 	}
-	name := req.Question[0].Name
-	for _, pattern := range r.blocked {
-		if strings.Contains(name, pattern) {
-			r.reply(rw, req, nil)
+	name, qtype := req.Question[0].Name, req.Question[0].Qtype
+	client := clientIP(rw)
+	for _, rule := range r.blocked {
+		if rule.match(name, qtype, client) {
+			r.reply(rw, req, nil, 0, rule)
 			return
 		}
 	}
-	for _, pattern := range r.hijacked {
-		if strings.Contains(name, pattern) {
-			r.reply(rw, req, []net.IP{net.IPv4(127, 0, 0, 1)})
+	for _, rule := range r.hijacked {
+		if rule.match(name, qtype, client) {
+			r.hijack(rw, req, rule)
 			return
 		}
 	}
-	for _, pattern := range r.ignored {
-		if strings.Contains(name, pattern) {
+	for _, rule := range r.ignored {
+		if rule.match(name, qtype, client) {
+			return
+		}
+	}
+	if r.Zone != nil {
+		answer, found := r.Zone.lookup(name, qtype)
+		if found || !r.ZoneFallback {
+			r.authoritative(rw, req, answer, found)
 			return
 		}
 	}
 	r.roundtrip(rw, req)
 }
 
+// clientIP returns the IP address of the client or nil.
+func clientIP(rw dns.ResponseWriter) net.IP {
+	switch addr := rw.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	default:
+		return nil
+	}
+}
+
 // Start starts the DNS resolver
 func (r *CensoringResolver) Start(address string) (*dns.Server, error) {
 	packetconn, err := net.ListenPacket("udp", address)
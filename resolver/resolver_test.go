@@ -1,8 +1,12 @@
 package resolver
 
 import (
+	"context"
+	"errors"
+	"net"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 	"github.com/ooni/jafar/uncensored"
@@ -40,17 +44,449 @@ func TestIntegrationLookupFailure(t *testing.T) {
 	killserver(t, server)
 }
 
+func TestIntegrationRedirectWithRule(t *testing.T) {
+	server := newresolver(t, nil, []string{
+		"ooni.nu:addr=10.10.34.34:addr=10.10.34.35:ttl=300",
+	}, nil)
+	reply := exchange(t, server, "hkgmetadb.ooni.nu", dns.TypeA)
+	if reply.Rcode != dns.RcodeSuccess {
+		t.Fatal("unexpected rcode")
+	}
+	if len(reply.Answer) != 2 {
+		t.Fatal("unexpected number of answers")
+	}
+	for _, answer := range reply.Answer {
+		if answer.Header().Ttl != 300 {
+			t.Fatal("unexpected TTL")
+		}
+	}
+	killserver(t, server)
+}
+
+func TestHijackShape(t *testing.T) {
+	resolver, err := NewCensoringResolver(nil, []string{
+		"ooni.nu:cname=blockpage.isp.example:cname=lb.isp.example" +
+			":addr=10.10.34.34:addr=[fd00::1]:ns=ns.isp.example" +
+			":authority:glue=192.0.2.53:glue=[2001:db8::53]:ttl=60",
+	}, nil, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := &capturingResponseWriter{}
+	resolver.ServeDNS(rw, newquery("hkgmetadb.ooni.nu"))
+	if rw.msg.Rcode != dns.RcodeSuccess {
+		t.Fatal("unexpected rcode")
+	}
+	expectAnswer := []string{
+		"hkgmetadb.ooni.nu.\t60\tIN\tCNAME\tblockpage.isp.example.",
+		"blockpage.isp.example.\t60\tIN\tCNAME\tlb.isp.example.",
+		"lb.isp.example.\t60\tIN\tA\t10.10.34.34",
+	}
+	checkrecords(t, rw.msg.Answer, expectAnswer)
+	checkrecords(t, rw.msg.Ns, []string{
+		"lb.isp.example.\t60\tIN\tNS\tns.isp.example.",
+	})
+	checkrecords(t, rw.msg.Extra, []string{
+		"ns.isp.example.\t60\tIN\tA\t192.0.2.53",
+		"ns.isp.example.\t60\tIN\tAAAA\t2001:db8::53",
+	})
+	// Without glue addresses, the additional section is empty
+	resolver, err = NewCensoringResolver(nil, []string{
+		"ooni.nu:addr=10.10.34.34:ns=ns.isp.example:authority:additional",
+	}, nil, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw = &capturingResponseWriter{}
+	resolver.ServeDNS(rw, newquery("hkgmetadb.ooni.nu"))
+	if len(rw.msg.Ns) != 1 || len(rw.msg.Extra) != 0 {
+		t.Fatal("unexpected authority or additional section")
+	}
+}
+
+func TestHijackNoMatchingFamily(t *testing.T) {
+	resolver, err := NewCensoringResolver(
+		nil, []string{"ooni.nu"}, nil, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw := &capturingResponseWriter{}
+	query := newquery("hkgmetadb.ooni.nu")
+	query.Question[0].Qtype = dns.TypeAAAA
+	resolver.ServeDNS(rw, query)
+	if rw.msg.Rcode != dns.RcodeNameError {
+		t.Fatal("unexpected rcode")
+	}
+}
+
+func TestNewCensoringResolverInapplicableOptions(t *testing.T) {
+	for _, tc := range []struct {
+		blocked, ignored []string
+	}{
+		{blocked: []string{"ooni.nu:addr=10.0.0.1"}},
+		{blocked: []string{"ooni.nu:qtype=A:authority"}},
+		{ignored: []string{"ooni.nu:ttl=60"}},
+		{ignored: []string{"ooni.nu:ecs=10.0.0.0/8"}},
+		{ignored: []string{"ooni.nu:addr=[::1"}},
+	} {
+		resolver, err := NewCensoringResolver(
+			tc.blocked, nil, tc.ignored, uncensored.DefaultClient)
+		if err == nil || resolver != nil {
+			t.Fatalf("expected an error for %+v", tc)
+		}
+	}
+	_, err := NewCensoringResolver(
+		[]string{"ooni.nu:qtype=A:ecs=10.0.0.0/8"}, nil,
+		[]string{"ooni.nu:client=10.0.0.1"}, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewCensoringResolverInvalidRule(t *testing.T) {
+	resolver, err := NewCensoringResolver(
+		nil, []string{"ooni.nu:addr=antani"}, nil, uncensored.DefaultClient)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if resolver != nil {
+		t.Fatal("expected nil resolver here")
+	}
+}
+
+func TestLookupTimeout(t *testing.T) {
+	resolver, err := NewCensoringResolver(
+		nil, nil, nil, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver.Timeout = 10 * time.Millisecond
+	resolver.TimeoutRcode = dns.RcodeRefused
+	unblock := make(chan interface{})
+	defer close(unblock)
+	resolver.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		<-unblock // ignore the context to check we don't depend on it
+		return nil, errors.New("mocked error")
+	}
+	rw := &capturingResponseWriter{}
+	resolver.ServeDNS(rw, newquery("example.com"))
+	if rw.msg.Rcode != dns.RcodeRefused {
+		t.Fatal("unexpected rcode")
+	}
+}
+
+func TestLookupCache(t *testing.T) {
+	resolver, err := NewCensoringResolver(
+		nil, nil, nil, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver.CacheTTL = time.Minute
+	var calls int
+	resolver.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		calls++
+		return []string{"93.184.216.34"}, nil
+	}
+	for i := 0; i < 3; i++ {
+		rw := &capturingResponseWriter{}
+		resolver.ServeDNS(rw, newquery("example.com"))
+		if rw.msg.Rcode != dns.RcodeSuccess {
+			t.Fatal("unexpected rcode")
+		}
+		if len(rw.msg.Answer) != 1 {
+			t.Fatal("unexpected number of answers")
+		}
+		if ttl := rw.msg.Answer[0].Header().Ttl; ttl < 59 || ttl > 60 {
+			t.Fatal("unexpected TTL")
+		}
+	}
+	if calls != 1 {
+		t.Fatal("expected the cache to avoid further lookups")
+	}
+}
+
+func TestLookupTTL(t *testing.T) {
+	resolver, err := NewCensoringResolver(
+		nil, nil, nil, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver.CacheTTL = time.Minute
+	now := time.Now()
+	resolver.cache.now = func() time.Time {
+		return now
+	}
+	var calls int
+	resolver.exchange = func(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+		calls++
+		reply := new(dns.Msg)
+		reply.SetReply(query)
+		if query.Question[0].Qtype == dns.TypeA {
+			for _, s := range []string{
+				"example.com. 300 IN CNAME www.example.com.",
+				"www.example.com. 30 IN A 93.184.216.34",
+			} {
+				rr, err := dns.NewRR(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				reply.Answer = append(reply.Answer, rr)
+			}
+		}
+		return reply, nil
+	}
+	for _, tc := range []struct {
+		elapsed time.Duration
+		ttl     uint32
+		calls   int
+	}{
+		{0, 30, 2},                // the minimum TTL of the answers
+		{10 * time.Second, 20, 2}, // decremented by the cache
+		{20 * time.Second, 30, 4}, // expired, thus resolved again
+	} {
+		now = now.Add(tc.elapsed)
+		rw := &capturingResponseWriter{}
+		resolver.ServeDNS(rw, newquery("example.com"))
+		if rw.msg.Rcode != dns.RcodeSuccess || len(rw.msg.Answer) != 1 {
+			t.Fatal("unexpected reply")
+		}
+		if ttl := rw.msg.Answer[0].Header().Ttl; ttl != tc.ttl {
+			t.Fatalf("expected TTL %d, got %d", tc.ttl, ttl)
+		}
+		if calls != tc.calls {
+			t.Fatalf("expected %d calls, got %d", tc.calls, calls)
+		}
+	}
+}
+
+func TestLookupErrorsAreNotCached(t *testing.T) {
+	resolver, err := NewCensoringResolver(
+		nil, nil, nil, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver.CacheTTL = time.Minute
+	var calls int
+	resolver.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		calls++
+		return nil, errors.New("mocked error")
+	}
+	for i := 0; i < 2; i++ {
+		rw := &capturingResponseWriter{}
+		resolver.ServeDNS(rw, newquery("example.com"))
+		if rw.msg.Rcode != dns.RcodeNameError {
+			t.Fatal("unexpected rcode")
+		}
+	}
+	if calls != 2 {
+		t.Fatal("expected errors not to be cached")
+	}
+}
+
+func TestZone(t *testing.T) {
+	zone, err := ParseZone(strings.NewReader(masterZone), "zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver, err := NewCensoringResolver(
+		[]string{"blocked.example.com"}, nil, nil, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver.Zone = zone
+	var calls int
+	resolver.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		calls++
+		return []string{"10.0.0.1"}, nil
+	}
+	server, err := resolver.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer killserver(t, server)
+	t.Run("answer", func(t *testing.T) {
+		reply := exchange(t, server, "example.com", dns.TypeA)
+		if reply.Rcode != dns.RcodeSuccess || !reply.Authoritative {
+			t.Fatal("expected authoritative success")
+		}
+		checkrecords(t, reply.Answer, []string{
+			"example.com.\t3600\tIN\tA\t93.184.216.34",
+		})
+	})
+	t.Run("nodata", func(t *testing.T) {
+		reply := exchange(t, server, "example.com", dns.TypeAAAA)
+		if reply.Rcode != dns.RcodeSuccess || !reply.Authoritative {
+			t.Fatal("expected authoritative success")
+		}
+		if len(reply.Answer) != 0 || len(reply.Ns) != 1 {
+			t.Fatal("expected no answers and the SOA")
+		}
+	})
+	t.Run("nxdomain", func(t *testing.T) {
+		reply := exchange(t, server, "antani.example.com", dns.TypeA)
+		if reply.Rcode != dns.RcodeNameError || !reply.Authoritative {
+			t.Fatal("expected authoritative NXDOMAIN")
+		}
+	})
+	t.Run("rules come first", func(t *testing.T) {
+		reply := exchange(t, server, "blocked.example.com", dns.TypeA)
+		if reply.Rcode != dns.RcodeNameError || reply.Authoritative {
+			t.Fatal("expected non-authoritative NXDOMAIN")
+		}
+	})
+	if calls != 0 {
+		t.Fatal("expected not to use the uncensored resolver")
+	}
+}
+
+func TestZoneFallback(t *testing.T) {
+	zone, err := ParseZone(strings.NewReader(hostsZone), "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver, err := NewCensoringResolver(nil, nil, nil, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver.Zone = zone
+	resolver.ZoneFallback = true
+	resolver.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"10.0.0.1"}, nil
+	}
+	rw := &capturingResponseWriter{}
+	resolver.ServeDNS(rw, newquery("example.org"))
+	if rw.msg.Rcode != dns.RcodeSuccess || rw.msg.Authoritative {
+		t.Fatal("expected non-authoritative success")
+	}
+	checkrecords(t, rw.msg.Answer, []string{"example.org.\t0\tIN\tA\t10.0.0.1"})
+	rw = &capturingResponseWriter{}
+	resolver.ServeDNS(rw, newquery("example.com"))
+	if rw.msg.Rcode != dns.RcodeSuccess || !rw.msg.Authoritative {
+		t.Fatal("expected authoritative success")
+	}
+}
+
+func TestClientAwareRules(t *testing.T) {
+	resolver, err := NewCensoringResolver(
+		[]string{"ooni.io:client=10.0.0.0/8:qtype=AAAA"},
+		[]string{"ooni.io:client=192.168.1.17:qtype=a:qtype=HTTPS"},
+		[]string{"ooni.io:client=[fd00::/8]"},
+		uncensored.DefaultClient,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"10.0.0.1", "fd00::1"}, nil
+	}
+	tests := []struct {
+		name   string
+		client net.IP
+		qtype  uint16
+		expect string // one of: blocked, hijacked, ignored, success
+	}{{
+		name:   "blocked client and qtype",
+		client: net.IPv4(10, 1, 2, 3),
+		qtype:  dns.TypeAAAA,
+		expect: "blocked",
+	}, {
+		name:   "blocked client but other qtype",
+		client: net.IPv4(10, 1, 2, 3),
+		qtype:  dns.TypeA,
+		expect: "success",
+	}, {
+		name:   "hijacked client and qtype",
+		client: net.IPv4(192, 168, 1, 17),
+		qtype:  dns.TypeA,
+		expect: "hijacked",
+	}, {
+		name:   "hijacked client and HTTPS qtype",
+		client: net.IPv4(192, 168, 1, 17),
+		qtype:  65,
+		expect: "blocked", // hijacking with no matching addresses
+	}, {
+		name:   "neighbour of hijacked client",
+		client: net.IPv4(192, 168, 1, 18),
+		qtype:  dns.TypeA,
+		expect: "success",
+	}, {
+		name:   "ignored client",
+		client: net.ParseIP("fd00::17"),
+		qtype:  dns.TypeA,
+		expect: "ignored",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := &capturingResponseWriter{remote: &net.UDPAddr{IP: tt.client}}
+			query := newquery("mia-ps.ooni.io")
+			query.Question[0].Qtype = tt.qtype
+			resolver.ServeDNS(rw, query)
+			switch tt.expect {
+			case "ignored":
+				if rw.msg != nil {
+					t.Fatal("expected the query to be ignored")
+				}
+			case "blocked":
+				checkblocked(t, rw.msg)
+			case "hijacked":
+				checkhijacked(t, rw.msg)
+			case "success":
+				checksuccess(t, rw.msg)
+			}
+		})
+	}
+}
+
+func TestNewCensoringResolverInvalidBlockedRule(t *testing.T) {
+	resolver, err := NewCensoringResolver(
+		[]string{"ooni.io:client=antani"}, nil, nil, uncensored.DefaultClient)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if resolver != nil {
+		t.Fatal("expected nil resolver here")
+	}
+}
+
+func TestNewCensoringResolverInvalidIgnoredRule(t *testing.T) {
+	resolver, err := NewCensoringResolver(
+		nil, nil, []string{"ooni.io:qtype=antani"}, uncensored.DefaultClient)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if resolver != nil {
+		t.Fatal("expected nil resolver here")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tcp := &capturingResponseWriter{remote: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}}
+	if ip := clientIP(tcp); !ip.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatal("unexpected client IP")
+	}
+	unix := &capturingResponseWriter{remote: &net.UnixAddr{Name: "/antani"}}
+	if ip := clientIP(unix); ip != nil {
+		t.Fatal("expected nil client IP")
+	}
+}
+
 func TestFailureNoQuestion(t *testing.T) {
-	resolver := NewCensoringResolver(
+	resolver, err := NewCensoringResolver(
 		nil, nil, nil, uncensored.DefaultClient,
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
 	resolver.ServeDNS(&fakeResponseWriter{t: t}, new(dns.Msg))
 }
 
 func TestListenFailure(t *testing.T) {
-	resolver := NewCensoringResolver(
+	resolver, err := NewCensoringResolver(
 		nil, nil, nil, uncensored.DefaultClient,
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
 	server, err := resolver.Start("8.8.8.8:53")
 	if err == nil {
 		t.Fatal("expected an error here")
@@ -61,12 +497,15 @@ func TestListenFailure(t *testing.T) {
 }
 
 func newresolver(t *testing.T, blocked, hijacked, ignored []string) *dns.Server {
-	resolver := NewCensoringResolver(
+	resolver, err := NewCensoringResolver(
 		blocked, hijacked, ignored,
 		// using faster dns because dot here causes miekg/dns's
 		// dns.Exchange to timeout and I don't want more complexity
 		uncensored.Must(uncensored.NewClient("system:///")),
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
 	server, err := resolver.Start("127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
@@ -165,9 +604,52 @@ type fakeResponseWriter struct {
 	t *testing.T
 }
 
+func (rw *fakeResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 54321}
+}
+
 func (rw *fakeResponseWriter) WriteMsg(m *dns.Msg) error {
 	if m.Rcode != dns.RcodeServerFailure {
 		rw.t.Fatal("unexpected rcode")
 	}
 	return nil
 }
+
+type capturingResponseWriter struct {
+	dns.ResponseWriter
+	msg    *dns.Msg
+	remote net.Addr
+}
+
+func (rw *capturingResponseWriter) RemoteAddr() net.Addr {
+	if rw.remote != nil {
+		return rw.remote
+	}
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 54321}
+}
+
+func (rw *capturingResponseWriter) WriteMsg(m *dns.Msg) error {
+	rw.msg = m
+	return nil
+}
+
+func exchange(t *testing.T, server *dns.Server, host string, qtype uint16) *dns.Msg {
+	query := newquery(host)
+	query.Question[0].Qtype = qtype
+	reply, err := dns.Exchange(query, server.PacketConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func checkrecords(t *testing.T, records []dns.RR, expect []string) {
+	if len(records) != len(expect) {
+		t.Fatalf("expected %d records, got %d", len(expect), len(records))
+	}
+	for idx, record := range records {
+		if record.String() != expect[idx] {
+			t.Fatalf("expected %q, got %q", expect[idx], record.String())
+		}
+	}
+}
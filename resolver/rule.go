@@ -0,0 +1,289 @@
+package resolver
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/ooni/jafar/internal/rulex"
+)
+
+// Rule is a censorship rule. The rule matches when the query name
+// contains Keyword and, if Clients and Qtypes are not empty, when the
+// client address and the query type are, respectively, in Clients and
+// in Qtypes. The other fields describe the shape of the forged reply
+// that we send back when the rule is a hijacking rule.
+type Rule struct {
+	Keyword     string       // keyword that must appear in the query
+	Clients     []*net.IPNet // clients to which the rule applies
+	Qtypes      []uint16     // query types to which the rule applies
+	Addresses   []net.IP     // addresses to return (default: 127.0.0.1)
+	CNAMEs      []string     // CNAME chain leading to Addresses
+	Nameservers []string     // nameservers for Authority and Additional
+	Glue        []net.IP     // addresses of the nameservers for Additional
+	TTL         uint32       // TTL of the forged records
+	Authority   bool         // whether to fill the authority section
+	Additional  bool         // whether to fill the additional section
+	EDNSOptions []dns.EDNS0  // bogus EDNS0 options to add to the reply
+}
+
+// ParseRule parses a rule. The syntax is `keyword[:option...]` where
+// the options are the following:
+//
+// - `client=CIDR` restricts the rule to clients in CIDR, which may
+// also be a single IP address;
+//
+// - `qtype=TYPE` restricts the rule to queries of type TYPE (e.g.,
+// `AAAA`, `HTTPS` or `TYPE65`);
+//
+// - `addr=IP` adds IP to the returned addresses;
+//
+// - `cname=NAME` appends NAME to the CNAME chain;
+//
+// - `ns=NAME` adds NAME to the nameservers;
+//
+// - `ttl=N` sets the TTL of the forged records;
+//
+// - `authority` adds NS records to the authority section;
+//
+// - `additional` adds glue records to the additional section, using the
+// addresses specified with `glue`, if any;
+//
+// - `glue=IP` adds IP to the addresses of the nameservers and implies
+// `additional`;
+//
+// - `ednsopt=CODE/HEX` adds an EDNS0 option with code CODE and the
+// hex encoded HEX payload to the reply;
+//
+// - `ecs=CIDR` adds a forged EDNS Client Subnet option to the reply.
+//
+// Use `addr=[::1]` and `glue=[::1]` to specify IPv6 addresses. The EDNS0
+// options are added both to the replies of blocking and of hijacking
+// rules. NewCensoringResolver rejects blocking rules using the options
+// that only apply to hijacking rules, and ignoring rules using options
+// other than `client` and `qtype`.
+//
+// Since rules have options, keywords containing colons or square brackets
+// need escaping, as explained in package rulex.
+func ParseRule(s string) (*Rule, error) {
+	parsed, err := rulex.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	rule := &Rule{Keyword: parsed.Pattern}
+	for _, option := range parsed.Options {
+		switch option.Name {
+		case "client":
+			client, err := parseClient(option.Value)
+			if err != nil {
+				return nil, err
+			}
+			rule.Clients = append(rule.Clients, client)
+		case "qtype":
+			qtype, err := parseQtype(option.Value)
+			if err != nil {
+				return nil, err
+			}
+			rule.Qtypes = append(rule.Qtypes, qtype)
+		case "addr":
+			ip := net.ParseIP(option.Value)
+			if ip == nil {
+				return nil, fmt.Errorf("resolver: invalid address: %s", option.Value)
+			}
+			rule.Addresses = append(rule.Addresses, ip)
+		case "glue":
+			ip := net.ParseIP(option.Value)
+			if ip == nil {
+				return nil, fmt.Errorf("resolver: invalid glue: %s", option.Value)
+			}
+			rule.Glue = append(rule.Glue, ip)
+			rule.Additional = true
+		case "cname":
+			rule.CNAMEs = append(rule.CNAMEs, dns.Fqdn(option.Value))
+		case "ns":
+			rule.Nameservers = append(rule.Nameservers, dns.Fqdn(option.Value))
+		case "ttl":
+			ttl, err := strconv.ParseUint(option.Value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("resolver: invalid ttl: %w", err)
+			}
+			rule.TTL = uint32(ttl)
+		case "authority":
+			rule.Authority = true
+		case "additional":
+			rule.Additional = true
+		case "ednsopt":
+			option, err := parseEDNSOption(option.Value)
+			if err != nil {
+				return nil, err
+			}
+			rule.EDNSOptions = append(rule.EDNSOptions, option)
+		case "ecs":
+			_, ipnet, err := net.ParseCIDR(option.Value)
+			if err != nil {
+				return nil, fmt.Errorf("resolver: invalid ecs: %w", err)
+			}
+			rule.EDNSOptions = append(rule.EDNSOptions, newsubnet(ipnet))
+		default:
+			return nil, rulex.Unknown(option)
+		}
+	}
+	if len(rule.Addresses) <= 0 {
+		rule.Addresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	}
+	return rule, nil
+}
+
+// ParseRules is like ParseRule but parses a list of rules.
+func ParseRules(in []string) ([]*Rule, error) {
+	var out []*Rule
+	for _, s := range in {
+		rule, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rule)
+	}
+	return out, nil
+}
+
+// hijackOptions are the options that only hijacking rules may use.
+var hijackOptions = map[string]bool{
+	"addr":       true,
+	"additional": true,
+	"authority":  true,
+	"cname":      true,
+	"glue":       true,
+	"ns":         true,
+	"ttl":        true,
+}
+
+// replyOptions are the options that only the rules replying to the
+// query, i.e., blocking and hijacking rules, may use.
+var replyOptions = map[string]bool{
+	"ecs":     true,
+	"ednsopt": true,
+}
+
+// parseRulesWithout is like ParseRules but fails if a rule uses any of
+// the options in disallowed, which do not apply to kind rules.
+func parseRulesWithout(
+	in []string, kind string, disallowed ...map[string]bool,
+) ([]*Rule, error) {
+	for _, s := range in {
+		parsed, err := rulex.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		for _, option := range parsed.Options {
+			for _, options := range disallowed {
+				if options[option.Name] {
+					return nil, fmt.Errorf("resolver: cannot use %s with %s rules in %q",
+						option.Name, kind, s)
+				}
+			}
+		}
+	}
+	return ParseRules(in)
+}
+
+// parseClient parses either a CIDR or a single IP address.
+func parseClient(s string) (*net.IPNet, error) {
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		return ipnet, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("resolver: invalid client: %s", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// parseEDNSOption parses an EDNS0 option written as `CODE/HEX`.
+func parseEDNSOption(s string) (dns.EDNS0, error) {
+	v := strings.SplitN(s, "/", 2)
+	if len(v) != 2 {
+		return nil, fmt.Errorf("resolver: invalid ednsopt: %s", s)
+	}
+	code, err := strconv.ParseUint(v[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("resolver: invalid ednsopt code: %w", err)
+	}
+	data, err := hex.DecodeString(v[1])
+	if err != nil {
+		return nil, fmt.Errorf("resolver: invalid ednsopt data: %w", err)
+	}
+	return &dns.EDNS0_LOCAL{Code: uint16(code), Data: data}, nil
+}
+
+// extraTypes contains query types unknown to our version of miekg/dns.
+var extraTypes = map[string]uint16{
+	"SVCB":  64,
+	"HTTPS": 65,
+}
+
+// parseQtype parses a query type name such as `A` or `TYPE65`.
+func parseQtype(s string) (uint16, error) {
+	s = strings.ToUpper(s)
+	if qtype, found := dns.StringToType[s]; found {
+		return qtype, nil
+	}
+	if qtype, found := extraTypes[s]; found {
+		return qtype, nil
+	}
+	if strings.HasPrefix(s, "TYPE") {
+		if qtype, err := strconv.ParseUint(s[4:], 10, 16); err == nil {
+			return uint16(qtype), nil
+		}
+	}
+	return 0, fmt.Errorf("resolver: invalid qtype: %s", s)
+}
+
+// match returns whether the rule applies to a query for name and
+// qtype sent by client. A nil client only matches rules that are
+// not restricted to specific clients.
+func (rule *Rule) match(name string, qtype uint16, client net.IP) bool {
+	if !strings.Contains(name, rule.Keyword) {
+		return false
+	}
+	if len(rule.Qtypes) > 0 && !containsQtype(rule.Qtypes, qtype) {
+		return false
+	}
+	if len(rule.Clients) > 0 && !containsClient(rule.Clients, client) {
+		return false
+	}
+	return true
+}
+
+func containsQtype(qtypes []uint16, qtype uint16) bool {
+	for _, entry := range qtypes {
+		if entry == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+func containsClient(clients []*net.IPNet, client net.IP) bool {
+	for _, entry := range clients {
+		if client != nil && entry.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// nameservers returns the nameservers authoritative for owner.
+func (rule *Rule) nameservers(owner string) []string {
+	if len(rule.Nameservers) > 0 {
+		return rule.Nameservers
+	}
+	return []string{"ns1." + owner}
+}
@@ -0,0 +1,139 @@
+package resolver
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+	"github.com/ooni/jafar/internal/rulex"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		expect  *Rule
+		wantErr bool
+	}{{
+		name:  "keyword only",
+		input: "ooni.io",
+		expect: &Rule{
+			Keyword:   "ooni.io",
+			Addresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		},
+	}, {
+		name:  "all options",
+		input: "ooni.io:addr=10.10.34.34:addr=[::1]:cname=a.example:ns=ns.example:glue=192.0.2.53:ttl=17:authority",
+		expect: &Rule{
+			Keyword:     "ooni.io",
+			Addresses:   []net.IP{net.ParseIP("10.10.34.34"), net.ParseIP("::1")},
+			CNAMEs:      []string{"a.example."},
+			Nameservers: []string{"ns.example."},
+			Glue:        []net.IP{net.ParseIP("192.0.2.53")},
+			TTL:         17,
+			Authority:   true,
+			Additional:  true,
+		},
+	}, {
+		name:  "client and qtype",
+		input: "ooni.io:client=10.0.0.0/8:client=192.168.1.1:client=[::1]:qtype=aaaa:qtype=HTTPS:qtype=TYPE64",
+		expect: &Rule{
+			Keyword: "ooni.io",
+			Clients: []*net.IPNet{{
+				IP:   net.IPv4(10, 0, 0, 0).To4(),
+				Mask: net.CIDRMask(8, 32),
+			}, {
+				IP:   net.IPv4(192, 168, 1, 1).To4(),
+				Mask: net.CIDRMask(32, 32),
+			}, {
+				IP:   net.ParseIP("::1"),
+				Mask: net.CIDRMask(128, 128),
+			}},
+			Qtypes:    []uint16{28, 65, 64},
+			Addresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		},
+	}, {
+		name:  "edns options",
+		input: "ooni.io:ednsopt=65001/deadbeef:ecs=10.0.0.0/8",
+		expect: &Rule{
+			Keyword:   "ooni.io",
+			Addresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+			EDNSOptions: []dns.EDNS0{&dns.EDNS0_LOCAL{
+				Code: 65001,
+				Data: []byte{0xde, 0xad, 0xbe, 0xef},
+			}, &dns.EDNS0_SUBNET{
+				Code:          dns.EDNS0SUBNET,
+				Family:        1,
+				SourceNetmask: 8,
+				Address:       net.IPv4(10, 0, 0, 0).To4(),
+			}},
+		},
+	}, {
+		name:    "ednsopt without separator",
+		input:   "ooni.io:ednsopt=65001",
+		wantErr: true,
+	}, {
+		name:    "ednsopt with invalid code",
+		input:   "ooni.io:ednsopt=antani/deadbeef",
+		wantErr: true,
+	}, {
+		name:    "ednsopt with invalid data",
+		input:   "ooni.io:ednsopt=65001/antani",
+		wantErr: true,
+	}, {
+		name:    "invalid ecs",
+		input:   "ooni.io:ecs=antani",
+		wantErr: true,
+	}, {
+		name:    "invalid client",
+		input:   "ooni.io:client=antani",
+		wantErr: true,
+	}, {
+		name:    "invalid qtype",
+		input:   "ooni.io:qtype=TYPEantani",
+		wantErr: true,
+	}, {
+		name:    "invalid address",
+		input:   "ooni.io:addr=antani",
+		wantErr: true,
+	}, {
+		name:    "invalid glue",
+		input:   "ooni.io:glue=antani",
+		wantErr: true,
+	}, {
+		name:    "invalid ttl",
+		input:   "ooni.io:ttl=-1",
+		wantErr: true,
+	}, {
+		name:    "unknown option",
+		input:   "ooni.io:antani",
+		wantErr: true,
+	}, {
+		name:    "syntax error",
+		input:   "ooni.io:addr=[::1",
+		wantErr: true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := ParseRule(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.expect, rule); diff != "" {
+				t.Fatal(diff)
+			}
+		})
+	}
+}
+
+func TestParseRulesUnknownOption(t *testing.T) {
+	rules, err := ParseRules([]string{"ooni.io", "ooni.nu:antani"})
+	if !errors.Is(err, rulex.ErrUnknownOption) {
+		t.Fatal("not the error we expected")
+	}
+	if rules != nil {
+		t.Fatal("expected nil rules here")
+	}
+}
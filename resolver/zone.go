@@ -0,0 +1,158 @@
+package resolver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// maxCNAMEChain is the maximum number of CNAMEs we follow in a zone.
+const maxCNAMEChain = 8
+
+// Zone is a static zone for which the resolver is authoritative.
+type Zone struct {
+	records map[string][]dns.RR // indexed by lowercase owner name
+	soas    []*dns.SOA
+}
+
+// LoadZone loads the zone contained in the file at path. See ParseZone
+// for a description of the supported formats.
+func LoadZone(path string) (*Zone, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseZone(bytes.NewReader(data), path)
+}
+
+// ParseZone parses a zone. The zone is either in hosts(5) format, i.e.,
+// `<address> <name> [<alias>...]` lines, or it is a RFC 1035 master file.
+// We assume the hosts format when the first field of each non-empty and
+// non-comment line is an IP address. The filename is only used to make
+// error messages more informative. Names in a master file are relative
+// to the root unless there is an $ORIGIN directive.
+func ParseZone(r io.Reader, filename string) (*Zone, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	zone := &Zone{records: make(map[string][]dns.RR)}
+	if ishosts(data) {
+		err = zone.parseHosts(data)
+	} else {
+		err = zone.parseMaster(data, filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return zone, nil
+}
+
+// ishosts returns whether data looks like a file in hosts(5) format.
+func ishosts(data []byte) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(stripcomment(scanner.Text()))
+		if len(fields) > 0 && net.ParseIP(fields[0]) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// stripcomment removes a hosts(5) comment from line.
+func stripcomment(line string) string {
+	if idx := strings.Index(line, "#"); idx >= 0 {
+		return line[:idx]
+	}
+	return line
+}
+
+func (z *Zone) parseHosts(data []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(stripcomment(scanner.Text()))
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("resolver: hosts entry without names: %s", scanner.Text())
+		}
+		ip := net.ParseIP(fields[0])
+		for _, name := range fields[1:] {
+			name = dns.Fqdn(name)
+			for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				for _, rr := range addresses(name, qtype, []net.IP{ip}, 0) {
+					z.add(rr)
+				}
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func (z *Zone) parseMaster(data []byte, filename string) error {
+	zp := dns.NewZoneParser(bytes.NewReader(data), ".", filename)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		z.add(rr)
+	}
+	return zp.Err()
+}
+
+func (z *Zone) add(rr dns.RR) {
+	name := strings.ToLower(rr.Header().Name)
+	z.records[name] = append(z.records[name], rr)
+	if soa, ok := rr.(*dns.SOA); ok {
+		z.soas = append(z.soas, soa)
+	}
+}
+
+// lookup returns the records answering a query for name and qtype,
+// following CNAMEs within the zone. The boolean is false when the zone
+// does not contain name, i.e., when the answer should be NXDOMAIN.
+func (z *Zone) lookup(name string, qtype uint16) ([]dns.RR, bool) {
+	var answer []dns.RR
+	name = strings.ToLower(name)
+	records, found := z.records[name]
+	for i := 0; found && i < maxCNAMEChain; i++ {
+		var (
+			cname   *dns.CNAME
+			matched bool
+		)
+		for _, rr := range records {
+			switch {
+			case rr.Header().Rrtype == qtype || qtype == dns.TypeANY:
+				answer = append(answer, rr)
+				matched = true
+			case rr.Header().Rrtype == dns.TypeCNAME:
+				cname = rr.(*dns.CNAME)
+			}
+		}
+		if matched || cname == nil {
+			break
+		}
+		answer = append(answer, cname)
+		// Note: when the target is outside the zone, the next
+		// iteration finds no records and hence it breaks.
+		records = z.records[strings.ToLower(cname.Target)]
+	}
+	return answer, found
+}
+
+// soa returns the SOA of the closest enclosing zone of name or nil.
+func (z *Zone) soa(name string) *dns.SOA {
+	var out *dns.SOA
+	for _, soa := range z.soas {
+		if dns.IsSubDomain(soa.Hdr.Name, name) &&
+			(out == nil || dns.CountLabel(soa.Hdr.Name) > dns.CountLabel(out.Hdr.Name)) {
+			out = soa
+		}
+	}
+	return out
+}
@@ -0,0 +1,142 @@
+package resolver
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const hostsZone = `# a comment
+93.184.216.34  example.com  www.example.com # another comment
+
+2606:2800:220:1:248:1893:25c8:1946 example.com
+`
+
+const masterZone = `$ORIGIN example.com.
+$TTL 3600
+@     IN SOA ns1 hostmaster 1 7200 3600 1209600 3600
+@     IN NS  ns1
+@     IN A   93.184.216.34
+ns1   IN A   93.184.216.35
+www   IN CNAME cdn
+cdn   IN CNAME edge
+edge  IN A   93.184.216.36
+ext   IN CNAME www.example.org.
+`
+
+func TestParseZoneHosts(t *testing.T) {
+	zone, err := ParseZone(strings.NewReader(hostsZone), "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, found := zone.lookup("WWW.example.com.", dns.TypeA)
+	if !found {
+		t.Fatal("expected to find www.example.com")
+	}
+	checkrecords(t, answer, []string{"www.example.com.\t0\tIN\tA\t93.184.216.34"})
+	answer, found = zone.lookup("example.com.", dns.TypeAAAA)
+	if !found {
+		t.Fatal("expected to find example.com")
+	}
+	checkrecords(t, answer, []string{
+		"example.com.\t0\tIN\tAAAA\t2606:2800:220:1:248:1893:25c8:1946",
+	})
+	if _, found := zone.lookup("example.org.", dns.TypeA); found {
+		t.Fatal("did not expect to find example.org")
+	}
+}
+
+func TestParseZoneHostsWithoutNames(t *testing.T) {
+	zone, err := ParseZone(strings.NewReader("127.0.0.1\n"), "hosts")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if zone != nil {
+		t.Fatal("expected nil zone here")
+	}
+}
+
+func TestParseZoneMaster(t *testing.T) {
+	zone, err := ParseZone(strings.NewReader(masterZone), "example.com.zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, found := zone.lookup("www.example.com.", dns.TypeA)
+	if !found {
+		t.Fatal("expected to find www.example.com")
+	}
+	checkrecords(t, answer, []string{
+		"www.example.com.\t3600\tIN\tCNAME\tcdn.example.com.",
+		"cdn.example.com.\t3600\tIN\tCNAME\tedge.example.com.",
+		"edge.example.com.\t3600\tIN\tA\t93.184.216.36",
+	})
+	answer, found = zone.lookup("ext.example.com.", dns.TypeA)
+	if !found {
+		t.Fatal("expected to find ext.example.com")
+	}
+	checkrecords(t, answer, []string{
+		"ext.example.com.\t3600\tIN\tCNAME\twww.example.org.",
+	})
+	answer, found = zone.lookup("ns1.example.com.", dns.TypeAAAA)
+	if !found || answer != nil {
+		t.Fatal("expected NODATA for ns1.example.com")
+	}
+	if soa := zone.soa("antani.example.com."); soa == nil || soa.Hdr.Name != "example.com." {
+		t.Fatal("unexpected SOA")
+	}
+	if soa := zone.soa("example.org."); soa != nil {
+		t.Fatal("unexpected SOA")
+	}
+}
+
+func TestParseZoneMasterError(t *testing.T) {
+	zone, err := ParseZone(strings.NewReader("example.com. IN A antani\n"), "zone")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if zone != nil {
+		t.Fatal("expected nil zone here")
+	}
+}
+
+func TestParseZoneReadError(t *testing.T) {
+	expected := errors.New("mocked error")
+	zone, err := ParseZone(&errorReader{err: expected}, "zone")
+	if !errors.Is(err, expected) {
+		t.Fatal("not the error we expected")
+	}
+	if zone != nil {
+		t.Fatal("expected nil zone here")
+	}
+}
+
+func TestLoadZone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jafar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(path, []byte(hostsZone), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadZone(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadZone(filepath.Join(dir, "nonexistent")); err == nil {
+		t.Fatal("expected an error here")
+	}
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,140 @@
+package socksproxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/ooni/jafar/internal/rulex"
+)
+
+const (
+	// ActionReply is the action replying with a SOCKS error code.
+	ActionReply = "reply"
+
+	// ActionReset is the action resetting the connection.
+	ActionReset = "reset"
+
+	// ActionHang is the action never answering.
+	ActionHang = "hang"
+)
+
+// ReplyNotAllowed is the SOCKS5 reply code meaning that the connection
+// is not allowed by the ruleset, which is the default reply code.
+const ReplyNotAllowed = 2
+
+// Rule is a censorship rule. When Network is not nil, the rule matches
+// the IP addresses it contains, including the addresses of the domain
+// names the clients connect to. Otherwise, it matches the hosts, i.e.,
+// domain names or IP addresses in textual form, containing Keyword. When
+// Port is nonzero, the rule only matches that port.
+type Rule struct {
+	Keyword string     // matches hosts containing it
+	Network *net.IPNet // matches IP addresses it contains
+	Port    int        // matches the port, if nonzero
+	Action  string     // what to do if the rule matches
+	Reply   byte       // the reply code used by ActionReply
+}
+
+// ParseRule parses a rule. The syntax is `pattern[:option...]` where
+// pattern is an IP address, a CIDR, or a keyword, possibly empty to match
+// any host. Wrap IPv6 addresses and CIDRs within square brackets, and
+// escape keywords containing colons or brackets as explained in package
+// rulex. The options are the following:
+//
+// - `port=PORT` only matches the target port PORT;
+//
+// - `reply[=CODE]` replies with the SOCKS5 reply code CODE (by default
+// we use ReplyNotAllowed and this is the default action);
+//
+// - `reset` resets the connection;
+//
+// - `hang` never answers.
+//
+// When a client connects to a domain name and there are IP address or
+// CIDR rules, we resolve the domain name using the uncensored resolver,
+// match its addresses, and then connect to them.
+//
+// Rules also apply to UDP datagrams, which we drop regardless of the
+// action when a rule matches their destination.
+func ParseRule(s string) (*Rule, error) {
+	parsed, err := rulex.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	rule := &Rule{Action: ActionReply, Reply: ReplyNotAllowed}
+	if _, ipnet, err := net.ParseCIDR(parsed.Pattern); err == nil {
+		rule.Network = ipnet
+	} else if ip := net.ParseIP(parsed.Pattern); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		rule.Network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	} else {
+		rule.Keyword = parsed.Pattern
+	}
+	var action string
+	for _, option := range parsed.Options {
+		switch option.Name {
+		case "port":
+			rule.Port, err = strconv.Atoi(option.Value)
+			if err == nil && (rule.Port <= 0 || rule.Port > 65535) {
+				err = fmt.Errorf("socksproxy: invalid port: %s", option.Value)
+			}
+		case ActionReply, ActionReset, ActionHang:
+			if action != "" && action != option.Name {
+				return nil, fmt.Errorf("socksproxy: conflicting actions in %q", s)
+			}
+			action = option.Name
+			if option.Name == ActionReply && option.Value != "" {
+				var code int
+				code, err = strconv.Atoi(option.Value)
+				if err == nil && (code <= 0 || code > 255) {
+					err = fmt.Errorf("socksproxy: invalid reply: %s", option.Value)
+				}
+				rule.Reply = byte(code)
+			}
+		default:
+			err = rulex.Unknown(option)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if action != "" {
+		rule.Action = action
+	}
+	return rule, nil
+}
+
+// ParseRules is like ParseRule but parses a list of rules.
+func ParseRules(in []string) ([]*Rule, error) {
+	var out []*Rule
+	for _, s := range in {
+		rule, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rule)
+	}
+	return out, nil
+}
+
+// match returns whether the rule matches host, whose IP addresses are
+// addrs, and port.
+func (rule *Rule) match(host string, addrs []string, port int) bool {
+	if rule.Port != 0 && rule.Port != port {
+		return false
+	}
+	if rule.Network != nil {
+		for _, addr := range addrs {
+			if ip := net.ParseIP(addr); ip != nil && rule.Network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return strings.Contains(host, rule.Keyword)
+}
@@ -0,0 +1,99 @@
+package socksproxy
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ooni/jafar/internal/rulex"
+)
+
+func TestParseRule(t *testing.T) {
+	rule, err := ParseRule("ooni.io:port=443:reply=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Keyword != "ooni.io" || rule.Network != nil || rule.Port != 443 {
+		t.Fatal("unexpected pattern or port")
+	}
+	if rule.Action != ActionReply || rule.Reply != 5 {
+		t.Fatal("unexpected action or reply")
+	}
+	rule, err = ParseRule("[2001:db8::/32]:reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Network.String() != "2001:db8::/32" || rule.Action != ActionReset {
+		t.Fatal("unexpected network or action")
+	}
+	rule, err = ParseRule("1.1.1.1:hang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Network.String() != "1.1.1.1/32" || rule.Action != ActionHang {
+		t.Fatal("unexpected network or action")
+	}
+	rule, err = ParseRule("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Action != ActionReply || rule.Reply != ReplyNotAllowed {
+		t.Fatal("unexpected default action")
+	}
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	for _, input := range []string{
+		"ooni.io:port=0",
+		"ooni.io:port=65536",
+		"ooni.io:port=x",
+		"ooni.io:reply=0",
+		"ooni.io:reply=256",
+		"ooni.io:reply=x",
+		"ooni.io:reset:hang",
+		"[ooni.io",
+	} {
+		if _, err := ParseRule(input); err == nil {
+			t.Fatalf("expected an error for %s", input)
+		}
+	}
+}
+
+func TestParseRulesUnknownOption(t *testing.T) {
+	rules, err := ParseRules([]string{"ooni.io", "ooni.io:antani"})
+	if !errors.Is(err, rulex.ErrUnknownOption) {
+		t.Fatal("not the error we expected")
+	}
+	if rules != nil {
+		t.Fatal("expected nil rules here")
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	var inputs = []struct {
+		rule   string
+		host   string
+		addrs  []string
+		port   int
+		expect bool
+	}{
+		{"ooni.io", "api.ooni.io", nil, 443, true},
+		{"ooni.io", "example.com", nil, 443, false},
+		{"ooni.io:port=80", "api.ooni.io", nil, 443, false},
+		{":port=443", "example.com", nil, 443, true},
+		{"10.0.0.0/8", "10.1.2.3", []string{"10.1.2.3"}, 80, true},
+		{"10.0.0.0/8", "11.1.2.3", []string{"11.1.2.3"}, 80, false},
+		{"10.0.0.0/8", "ten.example", nil, 80, false},
+		{"10.0.0.0/8", "ten.example", []string{"::1", "10.0.0.10"}, 80, true},
+		{"10.0.0.0/8", "eleven.example", []string{"11.0.0.11"}, 80, false},
+		{"[::1]", "::1", []string{"::1"}, 80, true},
+	}
+	for _, input := range inputs {
+		rule, err := ParseRule(input.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rule.match(input.host, input.addrs, input.port) != input.expect {
+			t.Fatalf("unexpected result for %+v", input)
+		}
+	}
+}
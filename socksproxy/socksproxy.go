@@ -0,0 +1,437 @@
+// Package socksproxy contains a censoring SOCKS5 proxy
+package socksproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/ooni/probe-engine/netx/httptransport"
+)
+
+const (
+	socksVersion = 5
+
+	methodNoAuth       = 0
+	methodNoAcceptable = 0xff
+
+	commandConnect      = 1
+	commandUDPAssociate = 3
+
+	addressIPv4   = 1
+	addressDomain = 3
+	addressIPv6   = 4
+
+	replySucceeded           = 0
+	replyGeneralFailure      = 1
+	replyCommandNotSupported = 7
+	replyAddressNotSupported = 8
+)
+
+var (
+	errNoAcceptableMethod  = errors.New("socksproxy: no acceptable method")
+	errAddressNotSupported = errors.New("socksproxy: address not supported")
+	errInvalidVersion      = errors.New("socksproxy: invalid version")
+)
+
+// CensoringProxy is a censoring SOCKS5 proxy
+type CensoringProxy struct {
+	rules       []*Rule
+	dial        func(network, address string) (net.Conn, error)
+	lookupHost  func(ctx context.Context, host string) ([]string, error)
+	needsLookup bool
+}
+
+// Uncensored is the upstream, non censored client we use to resolve
+// domain names and to connect to the hosts.
+type Uncensored interface {
+	httptransport.Dialer
+	httptransport.Resolver
+}
+
+// NewCensoringProxy creates a new CensoringProxy instance using
+// the specified list of rules (see ParseRule). In its simplest form,
+// a rule is a keyword that triggers censorship if it appears in the
+// host a client wants to connect to. uncensored is the upstream, non
+// censored client we use to resolve domain names and to connect to the
+// hosts.
+func NewCensoringProxy(
+	rules []string, uncensored Uncensored,
+) (*CensoringProxy, error) {
+	parsed, err := ParseRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	p := &CensoringProxy{
+		rules: parsed,
+		dial: func(network, address string) (net.Conn, error) {
+			return uncensored.DialContext(context.Background(), network, address)
+		},
+		lookupHost: uncensored.LookupHost,
+	}
+	for _, rule := range parsed {
+		p.needsLookup = p.needsLookup || rule.Network != nil
+	}
+	return p, nil
+}
+
+// request is a SOCKS5 request
+type request struct {
+	command byte
+	host    string
+	port    int
+}
+
+// negotiate selects the authentication method. We only support
+// connecting without authentication.
+func negotiate(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return errInvalidVersion
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	if bytes.IndexByte(methods, methodNoAuth) < 0 {
+		conn.Write([]byte{socksVersion, methodNoAcceptable})
+		return errNoAcceptableMethod
+	}
+	_, err := conn.Write([]byte{socksVersion, methodNoAuth})
+	return err
+}
+
+// readrequest reads a SOCKS5 request.
+func readrequest(r io.Reader) (*request, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion {
+		return nil, errInvalidVersion
+	}
+	host, port, err := readaddress(r)
+	if err != nil {
+		return nil, err
+	}
+	return &request{command: header[1], host: host, port: port}, nil
+}
+
+// readaddress reads a SOCKS5 address, i.e., the address type, the
+// address, and the port.
+func readaddress(r io.Reader) (string, int, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return "", 0, err
+	}
+	var addr []byte
+	switch atyp[0] {
+	case addressIPv4:
+		addr = make([]byte, net.IPv4len)
+	case addressIPv6:
+		addr = make([]byte, net.IPv6len)
+	case addressDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", 0, err
+		}
+		addr = make([]byte, length[0])
+	default:
+		return "", 0, errAddressNotSupported
+	}
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", 0, err
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", 0, err
+	}
+	host := string(addr)
+	if atyp[0] != addressDomain {
+		host = net.IP(addr).String()
+	}
+	return host, int(binary.BigEndian.Uint16(port)), nil
+}
+
+// appendaddress appends the SOCKS5 encoding of addr to b. A nil addr
+// is encoded as the IPv4 unspecified address and port zero.
+func appendaddress(b []byte, addr net.Addr) []byte {
+	var (
+		ip   net.IP = net.IPv4zero
+		port int
+	)
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = v.IP, v.Port
+	case *net.UDPAddr:
+		ip, port = v.IP, v.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(append(b, addressIPv4), ip4...)
+	} else {
+		b = append(append(b, addressIPv6), ip.To16()...)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// writereply writes a SOCKS5 reply with the specified code and
+// bound address, which may be nil.
+func writereply(conn net.Conn, code byte, addr net.Addr) error {
+	_, err := conn.Write(appendaddress([]byte{socksVersion, code, 0}, addr))
+	return err
+}
+
+// reset closes the connection with a RST segment
+func reset(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
+
+// splice routes traffic between left and right until either of them
+// is closed and then closes both.
+func splice(left, right net.Conn) {
+	done := make(chan bool, 2)
+	go func() {
+		io.Copy(left, right)
+		done <- true
+	}()
+	go func() {
+		io.Copy(right, left)
+		done <- true
+	}()
+	<-done
+	left.Close()
+	right.Close()
+	<-done
+}
+
+// lookup returns the IP addresses of host. When host is a domain name,
+// we only resolve it if some rules match IP addresses, otherwise we let
+// the dialer resolve it and return nil.
+func (p *CensoringProxy) lookup(host string) []string {
+	if net.ParseIP(host) != nil {
+		return []string{host}
+	}
+	if !p.needsLookup {
+		return nil
+	}
+	addrs, err := p.lookupHost(context.Background(), host)
+	if err != nil {
+		log.WithError(err).Warn("socksproxy: p.lookupHost failed")
+		return nil
+	}
+	return addrs
+}
+
+// match returns the first rule matching host, whose IP addresses are
+// addrs, and port or nil.
+func (p *CensoringProxy) match(host string, addrs []string, port int) *Rule {
+	for _, rule := range p.rules {
+		if rule.match(host, addrs, port) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// dialany connects to the first reachable address among addrs, which
+// are the addresses we matched, or to host when addrs is empty.
+func (p *CensoringProxy) dialany(
+	network, host string, addrs []string, port int,
+) (conn net.Conn, err error) {
+	if len(addrs) <= 0 {
+		addrs = []string{host}
+	}
+	for _, addr := range addrs {
+		conn, err = p.dial(network, net.JoinHostPort(addr, strconv.Itoa(port)))
+		if err == nil {
+			break
+		}
+	}
+	return
+}
+
+// censor performs the action of rule on conn.
+func (p *CensoringProxy) censor(conn net.Conn, rule *Rule) {
+	switch rule.Action {
+	case ActionReset:
+		reset(conn)
+	case ActionHang:
+		// Read and discard until the client gives up
+		io.Copy(ioutil.Discard, conn)
+		conn.Close()
+	default:
+		writereply(conn, rule.Reply, nil)
+		conn.Close()
+	}
+}
+
+// handle implements the SOCKS5 proxy
+func (p *CensoringProxy) handle(clientconn net.Conn) {
+	if err := negotiate(clientconn); err != nil {
+		log.WithError(err).Warn("socksproxy: negotiate failed")
+		clientconn.Close()
+		return
+	}
+	req, err := readrequest(clientconn)
+	if err != nil {
+		log.WithError(err).Warn("socksproxy: readrequest failed")
+		if errors.Is(err, errAddressNotSupported) {
+			writereply(clientconn, replyAddressNotSupported, nil)
+		}
+		clientconn.Close()
+		return
+	}
+	switch req.command {
+	case commandConnect:
+		p.connect(clientconn, req)
+	case commandUDPAssociate:
+		p.associate(clientconn)
+	default:
+		writereply(clientconn, replyCommandNotSupported, nil)
+		clientconn.Close()
+	}
+}
+
+// connect implements the CONNECT command
+func (p *CensoringProxy) connect(clientconn net.Conn, req *request) {
+	address := net.JoinHostPort(req.host, strconv.Itoa(req.port))
+	addrs := p.lookup(req.host)
+	if rule := p.match(req.host, addrs, req.port); rule != nil {
+		log.Warnf("socksproxy: reject %s by policy", address)
+		p.censor(clientconn, rule)
+		return
+	}
+	serverconn, err := p.dialany("tcp", req.host, addrs, req.port)
+	if err != nil {
+		log.WithError(err).Warn("socksproxy: p.dial failed")
+		writereply(clientconn, replyGeneralFailure, nil)
+		clientconn.Close()
+		return
+	}
+	if err := writereply(clientconn, replySucceeded, serverconn.LocalAddr()); err != nil {
+		clientconn.Close()
+		serverconn.Close()
+		return
+	}
+	log.Infof("socksproxy: routing for %s", address)
+	splice(clientconn, serverconn)
+}
+
+// associate implements the UDP ASSOCIATE command. The association lasts
+// as long as the client keeps the control connection open.
+func (p *CensoringProxy) associate(clientconn net.Conn) {
+	defer clientconn.Close()
+	local, _ := clientconn.LocalAddr().(*net.TCPAddr)
+	remote, _ := clientconn.RemoteAddr().(*net.TCPAddr)
+	if local == nil || remote == nil {
+		writereply(clientconn, replyGeneralFailure, nil)
+		return
+	}
+	pconn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		log.WithError(err).Warn("socksproxy: net.ListenUDP failed")
+		writereply(clientconn, replyGeneralFailure, nil)
+		return
+	}
+	defer pconn.Close()
+	if err := writereply(clientconn, replySucceeded, pconn.LocalAddr()); err != nil {
+		return
+	}
+	go p.relay(pconn, remote.IP)
+	io.Copy(ioutil.Discard, clientconn)
+}
+
+// relay relays the datagrams that client sends to pconn until pconn
+// is closed. Each datagram starts with a SOCKS5 header containing the
+// destination. We drop fragments and datagrams matching the rules.
+func (p *CensoringProxy) relay(pconn *net.UDPConn, client net.IP) {
+	conns := make(map[string]net.Conn)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	buffer := make([]byte, 1<<16)
+	for {
+		count, source, err := pconn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if !source.IP.Equal(client) || count < 4 || buffer[2] != 0 {
+			continue
+		}
+		reader := bytes.NewReader(buffer[3:count])
+		host, port, err := readaddress(reader)
+		if err != nil {
+			continue
+		}
+		address := net.JoinHostPort(host, strconv.Itoa(port))
+		addrs := p.lookup(host)
+		if rule := p.match(host, addrs, port); rule != nil {
+			log.Warnf("socksproxy: drop datagram for %s by policy", address)
+			continue
+		}
+		header := append([]byte{}, buffer[:count-reader.Len()]...)
+		payload := buffer[count-reader.Len() : count]
+		serverconn, found := conns[address]
+		if !found {
+			serverconn, err = p.dialany("udp", host, addrs, port)
+			if err != nil {
+				log.WithError(err).Warn("socksproxy: p.dial failed")
+				continue
+			}
+			conns[address] = serverconn
+			go relayback(pconn, source, serverconn, header)
+		}
+		serverconn.Write(payload)
+	}
+}
+
+// relayback sends to client the datagrams received from serverconn
+// prefixed with header until serverconn is closed.
+func relayback(pconn *net.UDPConn, client *net.UDPAddr, serverconn net.Conn, header []byte) {
+	buffer := make([]byte, 1<<16)
+	for {
+		count, err := serverconn.Read(buffer)
+		if err != nil {
+			return
+		}
+		pconn.WriteToUDP(append(header, buffer[:count]...), client)
+	}
+}
+
+func (p *CensoringProxy) run(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil && strings.Contains(
+			err.Error(), "use of closed network connection") {
+			return
+		}
+		if err == nil {
+			go p.handle(conn)
+		}
+	}
+}
+
+// Start starts the censoring proxy.
+func (p *CensoringProxy) Start(address string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	go p.run(listener)
+	return listener, nil
+}
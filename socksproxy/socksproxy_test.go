@@ -0,0 +1,285 @@
+package socksproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ooni/jafar/uncensored"
+)
+
+func TestConnect(t *testing.T) {
+	echo := newecho(t)
+	defer echo.Close()
+	proxy, err := NewCensoringProxy([]string{
+		"blocked.example",
+		"10.0.0.0/8:reset",
+		"hang.example:hang",
+		":port=25:reply=5",
+	}, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		switch host {
+		case "allowed.example":
+			return []string{"192.0.2.1", "192.0.2.2"}, nil
+		case "internal.example":
+			return []string{"10.1.2.3"}, nil
+		}
+		return nil, errors.New("mocked error")
+	}
+	proxy.dial = func(network, address string) (net.Conn, error) {
+		// We connect to the addresses we have matched, in order
+		if address != "192.0.2.2:443" {
+			return nil, errors.New("mocked error")
+		}
+		return net.Dial(network, echo.Addr().String())
+	}
+	listener := startproxy(t, proxy)
+	defer listener.Close()
+
+	conn, reply := connect(t, listener.Addr(), domain("allowed.example", 443))
+	if reply != replySucceeded {
+		t.Fatal("unexpected reply")
+	}
+	conn.Write([]byte("ping"))
+	data := make([]byte, 4)
+	if _, err := io.ReadFull(conn, data); err != nil || string(data) != "ping" {
+		t.Fatal("unexpected echo")
+	}
+	conn.Close()
+
+	conn, reply = connect(t, listener.Addr(), domain("blocked.example", 443))
+	conn.Close()
+	if reply != ReplyNotAllowed {
+		t.Fatal("unexpected reply")
+	}
+	conn, reply = connect(t, listener.Addr(), domain("smtp.example", 25))
+	conn.Close()
+	if reply != 5 {
+		t.Fatal("unexpected reply")
+	}
+	conn, reply = connect(t, listener.Addr(), domain("failing.example", 443))
+	conn.Close()
+	if reply != replyGeneralFailure {
+		t.Fatal("unexpected reply")
+	}
+
+	for _, address := range [][]byte{ipv4(10, 1, 2, 3, 80), domain("internal.example", 80)} {
+		conn = handshake(t, listener.Addr())
+		conn.Write(append([]byte{socksVersion, commandConnect, 0}, address...))
+		if _, err := conn.Read(data); !errors.Is(err, syscall.ECONNRESET) {
+			t.Fatal("not the error we expected", err)
+		}
+		conn.Close()
+	}
+
+	conn = handshake(t, listener.Addr())
+	conn.Write(append([]byte{socksVersion, commandConnect, 0}, domain("hang.example", 80)...))
+	var neterr net.Error
+	if _, err := conn.Read(data); !errors.As(err, &neterr) || !neterr.Timeout() {
+		t.Fatal("not the error we expected", err)
+	}
+	conn.Close()
+}
+
+func TestNoAcceptableMethod(t *testing.T) {
+	proxy, err := NewCensoringProxy(nil, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := startproxy(t, proxy)
+	defer listener.Close()
+	conn := dial(t, listener.Addr())
+	defer conn.Close()
+	conn.Write([]byte{socksVersion, 1, 2})
+	data, err := readall(conn)
+	if err != nil || !bytes.Equal(data, []byte{socksVersion, methodNoAcceptable}) {
+		t.Fatal("unexpected reply")
+	}
+}
+
+func TestRequestErrors(t *testing.T) {
+	proxy, err := NewCensoringProxy(nil, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := startproxy(t, proxy)
+	defer listener.Close()
+	var inputs = []struct {
+		request []byte
+		reply   byte
+	}{
+		{append([]byte{socksVersion, 2, 0}, ipv4(127, 0, 0, 1, 80)...), replyCommandNotSupported},
+		{[]byte{socksVersion, commandConnect, 0, 7}, replyAddressNotSupported},
+	}
+	for _, input := range inputs {
+		conn := handshake(t, listener.Addr())
+		conn.Write(input.request)
+		data, err := readall(conn)
+		conn.Close()
+		if err != nil || len(data) < 2 || data[1] != input.reply {
+			t.Fatalf("unexpected reply for %v", input.request)
+		}
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buffer := make([]byte, 1024)
+		for {
+			count, addr, err := echo.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buffer[:count], addr)
+		}
+	}()
+	proxy, err := NewCensoringProxy([]string{"blocked.example"}, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.dial = func(network, address string) (net.Conn, error) {
+		if network != "udp" || address != "allowed.example:53" {
+			return nil, errors.New("mocked error")
+		}
+		return net.Dial(network, echo.LocalAddr().String())
+	}
+	listener := startproxy(t, proxy)
+	defer listener.Close()
+	conn := handshake(t, listener.Addr())
+	defer conn.Close()
+	conn.Write(append([]byte{socksVersion, commandUDPAssociate, 0}, ipv4(0, 0, 0, 0, 0)...))
+	reply, err := readrequest(conn) // same format as a request
+	if err != nil || reply.command != replySucceeded {
+		t.Fatal("unexpected reply")
+	}
+	pconn, err := net.Dial("udp", net.JoinHostPort(reply.host, strconv.Itoa(reply.port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pconn.Close()
+	pconn.SetDeadline(time.Now().Add(500 * time.Millisecond))
+	blocked := append(append([]byte{0, 0, 0}, domain("blocked.example", 53)...), "ping"...)
+	pconn.Write(blocked)
+	allowed := append(append([]byte{0, 0, 0}, domain("allowed.example", 53)...), "ping"...)
+	pconn.Write(allowed)
+	buffer := make([]byte, 1024)
+	count, err := pconn.Read(buffer)
+	if err != nil || !bytes.Equal(buffer[:count], allowed) {
+		t.Fatal("unexpected datagram")
+	}
+}
+
+func TestStartListenError(t *testing.T) {
+	proxy, err := NewCensoringProxy(nil, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := proxy.Start("8.8.8.8:80")
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if listener != nil {
+		t.Fatal("expected nil listener here")
+	}
+}
+
+func TestNewCensoringProxyInvalidRule(t *testing.T) {
+	proxy, err := NewCensoringProxy([]string{"ooni.io:port=x"}, uncensored.DefaultClient)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if proxy != nil {
+		t.Fatal("expected nil proxy here")
+	}
+}
+
+func newecho(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+func startproxy(t *testing.T, proxy *CensoringProxy) net.Listener {
+	listener, err := proxy.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener
+}
+
+func dial(t *testing.T, addr net.Addr) net.Conn {
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(500 * time.Millisecond))
+	return conn
+}
+
+// handshake connects to the proxy and selects no authentication.
+func handshake(t *testing.T, addr net.Addr) net.Conn {
+	conn := dial(t, addr)
+	conn.Write([]byte{socksVersion, 1, methodNoAuth})
+	data := make([]byte, 2)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte{socksVersion, methodNoAuth}) {
+		t.Fatal("unexpected method selection")
+	}
+	return conn
+}
+
+// connect sends a CONNECT request for address and returns the reply code.
+func connect(t *testing.T, proxy net.Addr, address []byte) (net.Conn, byte) {
+	conn := handshake(t, proxy)
+	conn.Write(append([]byte{socksVersion, commandConnect, 0}, address...))
+	reply, err := readrequest(conn) // same format as a request
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, reply.command
+}
+
+func domain(host string, port int) []byte {
+	out := append([]byte{addressDomain, byte(len(host))}, host...)
+	return append(out, byte(port>>8), byte(port))
+}
+
+func ipv4(a, b, c, d byte, port int) []byte {
+	return []byte{addressIPv4, a, b, c, d, byte(port >> 8), byte(port)}
+}
+
+func readall(conn net.Conn) ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := io.Copy(&buf, conn)
+	return buf.Bytes(), err
+}
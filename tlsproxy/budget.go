@@ -0,0 +1,66 @@
+package tlsproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// budget limits the traffic forwarded in both directions of a connection
+// and the time for which we forward it. The exceeded channel is closed
+// when the connection exceeds the budget.
+type budget struct {
+	exceeded  chan struct{}
+	limited   bool
+	mu        sync.Mutex
+	once      sync.Once
+	remaining int64
+	timer     *time.Timer
+}
+
+// newBudget creates a budget allowing to forward maxbytes bytes, unless
+// zero, for maxtime, unless zero. Call stop when done.
+func newBudget(maxbytes int64, maxtime time.Duration) *budget {
+	b := &budget{
+		exceeded:  make(chan struct{}),
+		limited:   maxbytes > 0,
+		remaining: maxbytes,
+	}
+	if maxtime > 0 {
+		b.timer = time.AfterFunc(maxtime, b.exceed)
+	}
+	return b
+}
+
+// spend spends count bytes and returns the number of bytes we can
+// forward, which is zero once the budget has been exceeded, and whether
+// these are the last bytes, in which case call exceed after forwarding.
+func (b *budget) spend(count int) (int, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.exceeded:
+		return 0, false
+	default:
+	}
+	if !b.limited {
+		return count, false
+	}
+	if int64(count) < b.remaining {
+		b.remaining -= int64(count)
+		return count, false
+	}
+	count, b.remaining = int(b.remaining), 0
+	return count, count > 0
+}
+
+// exceed marks the budget as exceeded.
+func (b *budget) exceed() {
+	b.once.Do(func() { close(b.exceeded) })
+}
+
+// stop releases the resources used by the budget.
+func (b *budget) stop() {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+}
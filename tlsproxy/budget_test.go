@@ -0,0 +1,43 @@
+package tlsproxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBudgetBytes(t *testing.T) {
+	b := newBudget(10, 0)
+	defer b.stop()
+	if n, last := b.spend(4); n != 4 || last {
+		t.Fatal("unexpected spend result", n, last)
+	}
+	if n, last := b.spend(10); n != 6 || !last {
+		t.Fatal("unexpected spend result", n, last)
+	}
+	if n, last := b.spend(1); n != 0 || last {
+		t.Fatal("unexpected spend result", n, last)
+	}
+	b.exceed()
+	select {
+	case <-b.exceeded:
+	default:
+		t.Fatal("expected the budget to be exceeded")
+	}
+	b.exceed() // idempotent
+}
+
+func TestBudgetTime(t *testing.T) {
+	b := newBudget(0, 10*time.Millisecond)
+	defer b.stop()
+	if n, last := b.spend(1 << 20); n != 1<<20 || last {
+		t.Fatal("unexpected spend result", n, last)
+	}
+	select {
+	case <-b.exceeded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the budget to be exceeded")
+	}
+	if n, _ := b.spend(1); n != 0 {
+		t.Fatal("expected zero bytes")
+	}
+}
@@ -0,0 +1,196 @@
+package tlsproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"time"
+)
+
+const (
+	// CertExpired is the certificate defect where the certificate
+	// has already expired.
+	CertExpired = "expired"
+
+	// CertNotYetValid is the certificate defect where the certificate
+	// is not valid yet.
+	CertNotYetValid = "notyetvalid"
+
+	// CertWrongHost is the certificate defect where the certificate
+	// is valid for another host.
+	CertWrongHost = "wronghost"
+
+	// CertSelfSigned is the certificate defect where the certificate
+	// is signed by itself.
+	CertSelfSigned = "selfsigned"
+
+	// CertUnknownCA is the certificate defect where the certificate
+	// is signed by a CA other than the CA of the proxy.
+	CertUnknownCA = "unknownca"
+
+	// CertWeakKey is the certificate defect where the certificate
+	// uses a 1024 bit RSA key.
+	CertWeakKey = "weakkey"
+
+	// CertNoIntermediate is the certificate defect where we do not
+	// send the intermediate CA that signed the certificate.
+	CertNoIntermediate = "nointermediate"
+)
+
+// defects contains the certificate defects.
+var defects = map[string]bool{
+	CertExpired:        true,
+	CertNotYetValid:    true,
+	CertWrongHost:      true,
+	CertSelfSigned:     true,
+	CertUnknownCA:      true,
+	CertWeakKey:        true,
+	CertNoIntermediate: true,
+}
+
+// wrongHost is the name for which CertWrongHost certificates are valid.
+const wrongHost = "wrong.host.invalid"
+
+const (
+	// authorityValidity is the validity of the CAs, which exceeds the
+	// lifetime of the process, since clients trust the CA we write.
+	authorityValidity = 10 * 365 * 24 * time.Hour
+
+	// leafValidity is the validity of the certificates we forge.
+	leafValidity = 24 * time.Hour
+
+	// leafRefresh is for how long we reuse a certificate we forged
+	// before forging it again, such that valid certificates do not
+	// expire and defective certificates keep their defect.
+	leafRefresh = time.Hour
+)
+
+// forgedCert is a certificate we forged.
+type forgedCert struct {
+	cert    *tls.Certificate
+	refresh time.Time
+}
+
+// errNoSNI indicates that we cannot forge a certificate without SNI.
+var errNoSNI = errors.New("tlsproxy: SNI not provided")
+
+// signer is a certificate along with its private key.
+type signer struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// newSigner creates a certificate for the specified names, valid from
+// notBefore to notAfter, with a new key, signed by parent, or by itself
+// when parent is nil. When weak is true, the key is a 1024 bit RSA key,
+// otherwise it is a P-256 ECDSA key.
+func newSigner(
+	names []string, notBefore, notAfter time.Time, isCA, weak bool, parent *signer,
+) (*signer, error) {
+	var (
+		key crypto.Signer
+		err error
+	)
+	if weak {
+		key, err = rsa.GenerateKey(rand.Reader, 1024)
+	} else {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[0], Organization: []string{"OONI"}},
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else if weak {
+		tmpl.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else if !isCA {
+			tmpl.DNSNames = append(tmpl.DNSNames, name)
+		}
+	}
+	if parent == nil {
+		parent = &signer{cert: tmpl, key: key}
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, parent.cert, key.Public(), parent.key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &signer{cert: cert, key: key}, nil
+}
+
+// forge returns a certificate for sni with the specified defect. We
+// sign the certificates using an intermediate CA signed by the CA of
+// the proxy, and we cache them by SNI and defect for leafRefresh.
+func (p *CensoringProxy) forge(sni, defect string) (*tls.Certificate, error) {
+	if sni == "" {
+		return nil, errNoSNI
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := sni + "/" + defect
+	now := time.Now()
+	if forged, found := p.certs[key]; found && now.Before(forged.refresh) {
+		return forged.cert, nil
+	}
+	var (
+		names     = []string{sni}
+		notBefore = now.Add(-time.Hour)
+		notAfter  = now.Add(leafValidity)
+		parent    = p.intermediate
+	)
+	switch defect {
+	case CertExpired:
+		notBefore, notAfter = now.Add(-2*leafValidity), now.Add(-leafValidity)
+	case CertNotYetValid:
+		notBefore, notAfter = now.Add(leafValidity), now.Add(2*leafValidity)
+	case CertWrongHost:
+		names = []string{wrongHost}
+	case CertSelfSigned:
+		parent = nil
+	case CertUnknownCA:
+		parent = p.unknownCA
+	}
+	leaf, err := newSigner(names, notBefore, notAfter, false, defect == CertWeakKey, parent)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{leaf.cert.Raw},
+		PrivateKey:  leaf.key,
+		Leaf:        leaf.cert,
+	}
+	if parent != nil && defect != CertNoIntermediate {
+		cert.Certificate = append(cert.Certificate, parent.cert.Raw)
+	}
+	p.certs[key] = forgedCert{cert: cert, refresh: now.Add(leafRefresh)}
+	return cert, nil
+}
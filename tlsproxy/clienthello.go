@@ -0,0 +1,490 @@
+package tlsproxy
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	recordTypeHandshake        = 22
+	handshakeTypeClientHello   = 1
+	handshakeTypeServerHello   = 2
+	maxRecordLength            = 1<<14 + 256
+	maxRecordPayload           = 1 << 14
+	maxClientHelloLength       = 1 << 17
+	extensionServerName        = 0
+	extensionSupportedGroups   = 10
+	extensionECPointFormats    = 11
+	extensionSignatureAlgs     = 13
+	extensionALPN              = 16
+	extensionSupportedVersions = 43
+	extensionECH               = 0xfe0d
+	extensionESNI              = 0xffce
+)
+
+var (
+	// ErrNotHandshake indicates that a record is not a handshake record.
+	ErrNotHandshake = errors.New("tlsproxy: not a handshake record")
+
+	// ErrNotClientHello indicates that a message is not a ClientHello.
+	ErrNotClientHello = errors.New("tlsproxy: not a ClientHello")
+
+	// ErrMalformed indicates that a ClientHello is malformed.
+	ErrMalformed = errors.New("tlsproxy: malformed ClientHello")
+)
+
+// Extension is a TLS extension.
+type Extension struct {
+	Type uint16
+	Data []byte
+}
+
+// ClientHello is a parsed ClientHello. Besides the fields of the message,
+// it contains the most useful extensions already parsed.
+type ClientHello struct {
+	RecordVersion       uint16      // version of the first record
+	Version             uint16      // legacy version of the ClientHello
+	Random              []byte      // client random
+	SessionID           []byte      // legacy session ID
+	CipherSuites        []uint16    // offered cipher suites
+	CompressionMethods  []byte      // offered compression methods
+	Extensions          []Extension // extensions in order
+	ServerName          string      // from the server_name extension
+	ALPN                []string    // from the ALPN extension
+	SupportedVersions   []uint16    // from the supported_versions extension
+	SupportedGroups     []uint16    // from the supported_groups extension
+	ECPointFormats      []byte      // from the ec_point_formats extension
+	SignatureAlgorithms []uint16    // from the signature_algorithms extension
+}
+
+// ReadClientHello reads the ClientHello from r, which may span over several
+// records. It returns the ClientHello as well as the bytes read from r,
+// which may be replayed to the server. The bytes are returned also in
+// case of failure, to allow forwarding whatever the client sent.
+func ReadClientHello(r io.Reader) (*ClientHello, []byte, error) {
+	var (
+		raw           []byte
+		msg           []byte
+		recordVersion uint16
+	)
+	for {
+		header := make([]byte, 5)
+		count, err := io.ReadFull(r, header)
+		raw = append(raw, header[:count]...)
+		if err != nil {
+			return nil, raw, err
+		}
+		if header[0] != recordTypeHandshake {
+			return nil, raw, ErrNotHandshake
+		}
+		if recordVersion == 0 {
+			recordVersion = binary.BigEndian.Uint16(header[1:3])
+		}
+		length := int(binary.BigEndian.Uint16(header[3:5]))
+		if length <= 0 || length > maxRecordLength {
+			return nil, raw, ErrMalformed
+		}
+		payload := make([]byte, length)
+		count, err = io.ReadFull(r, payload)
+		raw = append(raw, payload[:count]...)
+		if err != nil {
+			return nil, raw, err
+		}
+		msg = append(msg, payload...)
+		if len(msg) < 4 {
+			continue
+		}
+		if msg[0] != handshakeTypeClientHello {
+			return nil, raw, ErrNotClientHello
+		}
+		size := 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]))
+		if size > maxClientHelloLength {
+			return nil, raw, ErrMalformed
+		}
+		if len(msg) >= size {
+			hello, err := ParseClientHello(msg[:size])
+			if err != nil {
+				return nil, raw, err
+			}
+			hello.RecordVersion = recordVersion
+			return hello, raw, nil
+		}
+	}
+}
+
+// ParseClientHello parses a ClientHello handshake message, including
+// the handshake header, but without the record header.
+func ParseClientHello(msg []byte) (*ClientHello, error) {
+	p := &parser{data: msg}
+	if p.u8() != handshakeTypeClientHello {
+		return nil, ErrNotClientHello
+	}
+	p = &parser{data: p.vec(3)}
+	hello := &ClientHello{
+		Version:   p.u16(),
+		Random:    p.bytes(32),
+		SessionID: p.vec(1),
+	}
+	ciphers := &parser{data: p.vec(2)}
+	for !ciphers.empty() {
+		hello.CipherSuites = append(hello.CipherSuites, ciphers.u16())
+	}
+	p.bad = p.bad || ciphers.bad
+	hello.CompressionMethods = p.vec(1)
+	if !p.empty() {
+		extensions := &parser{data: p.vec(2)}
+		for !extensions.empty() {
+			ext := Extension{Type: extensions.u16(), Data: extensions.vec(2)}
+			if extensions.bad {
+				break
+			}
+			if err := hello.parseExtension(ext); err != nil {
+				return nil, err
+			}
+			hello.Extensions = append(hello.Extensions, ext)
+		}
+		p.bad = p.bad || extensions.bad
+	}
+	if p.bad || !p.empty() {
+		return nil, ErrMalformed
+	}
+	return hello, nil
+}
+
+// parseExtension parses the extensions we know about.
+func (hello *ClientHello) parseExtension(ext Extension) error {
+	p := &parser{data: ext.Data}
+	switch ext.Type {
+	case extensionServerName:
+		names := &parser{data: p.vec(2)}
+		for !names.empty() {
+			nameType, name := names.u8(), names.vec(2)
+			if nameType == 0 && !names.bad {
+				hello.ServerName = string(name)
+			}
+		}
+		p.bad = p.bad || names.bad
+	case extensionALPN:
+		protocols := &parser{data: p.vec(2)}
+		for !protocols.empty() {
+			if protocol := protocols.vec(1); !protocols.bad {
+				hello.ALPN = append(hello.ALPN, string(protocol))
+			}
+		}
+		p.bad = p.bad || protocols.bad
+	case extensionSupportedVersions:
+		versions := &parser{data: p.vec(1)}
+		for !versions.empty() {
+			hello.SupportedVersions = append(hello.SupportedVersions, versions.u16())
+		}
+		p.bad = p.bad || versions.bad
+	case extensionSupportedGroups:
+		groups := &parser{data: p.vec(2)}
+		for !groups.empty() {
+			hello.SupportedGroups = append(hello.SupportedGroups, groups.u16())
+		}
+		p.bad = p.bad || groups.bad
+	case extensionECPointFormats:
+		hello.ECPointFormats = p.vec(1)
+	case extensionSignatureAlgs:
+		algs := &parser{data: p.vec(2)}
+		for !algs.empty() {
+			hello.SignatureAlgorithms = append(hello.SignatureAlgorithms, algs.u16())
+		}
+		p.bad = p.bad || algs.bad
+	default:
+		return nil
+	}
+	if p.bad || !p.empty() {
+		return ErrMalformed
+	}
+	return nil
+}
+
+// HasExtension returns whether the ClientHello contains the extension.
+func (hello *ClientHello) HasExtension(extType uint16) bool {
+	for _, ext := range hello.Extensions {
+		if ext.Type == extType {
+			return true
+		}
+	}
+	return false
+}
+
+// HasECH returns whether the ClientHello contains the encrypted_client_hello
+// extension or the extension of the ESNI draft. In such case, ServerName is
+// the public name of the client-facing server, i.e., the outer SNI.
+func (hello *ClientHello) HasECH() bool {
+	return hello.HasExtension(extensionECH) || hello.HasExtension(extensionESNI)
+}
+
+// WithoutExtensions returns a copy of the ClientHello that does not
+// contain the extensions of the specified types.
+func (hello *ClientHello) WithoutExtensions(types ...uint16) *ClientHello {
+	out := *hello
+	out.Extensions = nil
+	for _, ext := range hello.Extensions {
+		if !containsUint16(types, ext.Type) {
+			out.Extensions = append(out.Extensions, ext)
+		}
+	}
+	return &out
+}
+
+// Marshal serializes the ClientHello as a sequence of handshake records
+// using RecordVersion. Note that only the fields of the message and
+// Extensions affect the result, while the parsed extensions do not.
+func (hello *ClientHello) Marshal() []byte {
+	var body []byte
+	body = appendUint16(body, hello.Version)
+	body = append(body, hello.Random...)
+	body = append(append(body, byte(len(hello.SessionID))), hello.SessionID...)
+	body = appendUint16(body, uint16(2*len(hello.CipherSuites)))
+	for _, suite := range hello.CipherSuites {
+		body = appendUint16(body, suite)
+	}
+	body = append(append(body, byte(len(hello.CompressionMethods))),
+		hello.CompressionMethods...)
+	if len(hello.Extensions) > 0 {
+		var extensions []byte
+		for _, ext := range hello.Extensions {
+			extensions = appendUint16(extensions, ext.Type)
+			extensions = appendUint16(extensions, uint16(len(ext.Data)))
+			extensions = append(extensions, ext.Data...)
+		}
+		body = appendUint16(body, uint16(len(extensions)))
+		body = append(body, extensions...)
+	}
+	msg := append([]byte{handshakeTypeClientHello, byte(len(body) >> 16),
+		byte(len(body) >> 8), byte(len(body))}, body...)
+	var out []byte
+	for len(msg) > 0 {
+		length := len(msg)
+		if length > maxRecordPayload {
+			length = maxRecordPayload
+		}
+		out = append(out, recordTypeHandshake)
+		out = appendUint16(out, hello.RecordVersion)
+		out = appendUint16(out, uint16(length))
+		out = append(out, msg[:length]...)
+		msg = msg[length:]
+	}
+	return out
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func containsUint16(values []uint16, value uint16) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxVersion returns the highest version offered by the client, using
+// supported_versions, if present, and the legacy version otherwise.
+func (hello *ClientHello) MaxVersion() uint16 {
+	var max uint16
+	for _, version := range hello.SupportedVersions {
+		if !isGREASE(version) && version > max {
+			max = version
+		}
+	}
+	if max == 0 {
+		max = hello.Version
+	}
+	return max
+}
+
+// JA3 returns the JA3 string of the ClientHello.
+func (hello *ClientHello) JA3() string {
+	var extensions []uint16
+	for _, ext := range hello.Extensions {
+		extensions = append(extensions, ext.Type)
+	}
+	var formats []uint16
+	for _, format := range hello.ECPointFormats {
+		formats = append(formats, uint16(format))
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(hello.Version)),
+		joinDecimal(hello.CipherSuites),
+		joinDecimal(extensions),
+		joinDecimal(hello.SupportedGroups),
+		joinDecimal(formats),
+	}, ",")
+}
+
+// JA3Hash returns the JA3 fingerprint, i.e., the MD5 of JA3.
+func (hello *ClientHello) JA3Hash() string {
+	sum := md5.Sum([]byte(hello.JA3()))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA4 returns the JA4 fingerprint of the ClientHello.
+func (hello *ClientHello) JA4() string {
+	sni := "i"
+	if hello.HasExtension(extensionServerName) {
+		sni = "d"
+	}
+	var ciphers, extensions []uint16
+	for _, cipher := range hello.CipherSuites {
+		if !isGREASE(cipher) {
+			ciphers = append(ciphers, cipher)
+		}
+	}
+	var count int
+	for _, ext := range hello.Extensions {
+		if isGREASE(ext.Type) {
+			continue
+		}
+		count++
+		if ext.Type != extensionServerName && ext.Type != extensionALPN {
+			extensions = append(extensions, ext.Type)
+		}
+	}
+	sort.Slice(ciphers, func(i, j int) bool { return ciphers[i] < ciphers[j] })
+	sort.Slice(extensions, func(i, j int) bool { return extensions[i] < extensions[j] })
+	extensionsText := joinHex(extensions)
+	if len(hello.SignatureAlgorithms) > 0 {
+		extensionsText += "_" + joinHex(hello.SignatureAlgorithms)
+	}
+	return fmt.Sprintf("t%s%s%02d%02d%s_%s_%s", ja4Version(hello.MaxVersion()),
+		sni, min99(len(ciphers)), min99(count), ja4ALPN(hello.ALPN),
+		ja4Hash(len(ciphers), joinHex(ciphers)),
+		ja4Hash(len(extensions), extensionsText))
+}
+
+// ja4Version returns the JA4 representation of version.
+func ja4Version(version uint16) string {
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	default:
+		return "00"
+	}
+}
+
+// ja4ALPN returns the JA4 representation of the first ALPN value.
+func ja4ALPN(alpn []string) string {
+	if len(alpn) <= 0 || alpn[0] == "" {
+		return "00"
+	}
+	first, last := alpn[0][0], alpn[0][len(alpn[0])-1]
+	if !isAlnum(first) || !isAlnum(last) {
+		text := hex.EncodeToString([]byte(alpn[0]))
+		return text[:1] + text[len(text)-1:]
+	}
+	return string([]byte{first, last})
+}
+
+// ja4Hash returns the truncated SHA256 of text, or zeros if count is zero.
+func ja4Hash(count int, text string) string {
+	if count <= 0 {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func min99(v int) int {
+	if v > 99 {
+		return 99
+	}
+	return v
+}
+
+func isAlnum(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+// isGREASE returns whether v is a GREASE value (RFC 8701).
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// joinDecimal joins the non-GREASE values using dashes.
+func joinDecimal(values []uint16) string {
+	var out []string
+	for _, v := range values {
+		if !isGREASE(v) {
+			out = append(out, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(out, "-")
+}
+
+// joinHex joins values in hex using commas.
+func joinHex(values []uint16) string {
+	var out []string
+	for _, v := range values {
+		out = append(out, fmt.Sprintf("%04x", v))
+	}
+	return strings.Join(out, ",")
+}
+
+// parser reads big endian values from data. When data is too short, it
+// sets bad and returns zero values.
+type parser struct {
+	data []byte
+	bad  bool
+}
+
+func (p *parser) empty() bool {
+	return p.bad || len(p.data) <= 0
+}
+
+func (p *parser) bytes(n int) []byte {
+	if p.bad || len(p.data) < n {
+		p.bad = true
+		return nil
+	}
+	out := p.data[:n]
+	p.data = p.data[n:]
+	return out
+}
+
+func (p *parser) u8() uint8 {
+	if b := p.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (p *parser) u16() uint16 {
+	if b := p.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// vec reads a vector whose length is encoded using size bytes.
+func (p *parser) vec(size int) []byte {
+	var length int
+	for _, b := range p.bytes(size) {
+		length = length<<8 | int(b)
+	}
+	return p.bytes(length)
+}
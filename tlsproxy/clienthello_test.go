@@ -0,0 +1,225 @@
+package tlsproxy
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"regexp"
+	"testing"
+	"testing/iotest"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// newClientHello returns the records containing the ClientHello sent
+// by a Go TLS client using config.
+func newClientHello(t *testing.T, config *tls.Config) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, config).Handshake()
+		client.Close()
+	}()
+	_, raw, err := ReadClientHello(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// fragment splits the handshake message contained in the single record
+// raw into several records containing at most size bytes.
+func fragment(raw []byte, size int) []byte {
+	var out []byte
+	msg := raw[5:]
+	for len(msg) > 0 {
+		count := size
+		if count > len(msg) {
+			count = len(msg)
+		}
+		out = append(out, raw[0], raw[1], raw[2], byte(count>>8), byte(count))
+		out = append(out, msg[:count]...)
+		msg = msg[count:]
+	}
+	return out
+}
+
+func TestReadClientHello(t *testing.T) {
+	raw := newClientHello(t, &tls.Config{
+		ServerName: "www.example.com",
+		NextProtos: []string{"h2", "http/1.1"},
+		MinVersion: tls.VersionTLS12,
+		MaxVersion: tls.VersionTLS13,
+	})
+	hello, _, err := ReadClientHello(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello.ServerName != "www.example.com" {
+		t.Fatal("unexpected SNI")
+	}
+	if diff := cmp.Diff([]string{"h2", "http/1.1"}, hello.ALPN); diff != "" {
+		t.Fatal(diff)
+	}
+	if hello.MaxVersion() != tls.VersionTLS13 || hello.Version != tls.VersionTLS12 {
+		t.Fatal("unexpected versions")
+	}
+	if len(hello.CipherSuites) <= 0 || len(hello.SupportedGroups) <= 0 ||
+		len(hello.SignatureAlgorithms) <= 0 || len(hello.Random) != 32 {
+		t.Fatal("missing fields")
+	}
+	if !hello.HasExtension(extensionServerName) || hello.HasExtension(0xfe0d) {
+		t.Fatal("unexpected extensions")
+	}
+	if !regexp.MustCompile(`^t13d\d{4}h2_[0-9a-f]{12}_[0-9a-f]{12}$`).MatchString(hello.JA4()) {
+		t.Fatal("unexpected JA4", hello.JA4())
+	}
+	if len(hello.JA3Hash()) != 32 {
+		t.Fatal("unexpected JA3 hash")
+	}
+}
+
+func TestReadClientHelloFragmented(t *testing.T) {
+	raw := newClientHello(t, &tls.Config{ServerName: "www.example.com"})
+	expect, _, err := ReadClientHello(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fragmented := fragment(raw, 50)
+	// Simulate TCP segmentation by returning one byte per read
+	hello, incoming, err := ReadClientHello(iotest.OneByteReader(bytes.NewReader(fragmented)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(expect, hello); diff != "" {
+		t.Fatal(diff)
+	}
+	if !bytes.Equal(incoming, fragmented) {
+		t.Fatal("unexpected incoming bytes")
+	}
+}
+
+func TestReadClientHelloErrors(t *testing.T) {
+	raw := newClientHello(t, &tls.Config{ServerName: "www.example.com"})
+	mutate := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte{}, raw...))
+	}
+	var inputs = []struct {
+		name   string
+		input  []byte
+		expect error
+	}{{
+		name:   "empty",
+		input:  nil,
+		expect: io.EOF,
+	}, {
+		name:   "truncated",
+		input:  raw[:len(raw)-1],
+		expect: io.ErrUnexpectedEOF,
+	}, {
+		name:   "not handshake",
+		input:  mutate(func(b []byte) []byte { b[0] = 23; return b }),
+		expect: ErrNotHandshake,
+	}, {
+		name:   "not ClientHello",
+		input:  mutate(func(b []byte) []byte { b[5] = 2; return b }),
+		expect: ErrNotClientHello,
+	}, {
+		name:   "empty record",
+		input:  []byte{22, 3, 1, 0, 0},
+		expect: ErrMalformed,
+	}, {
+		name: "trailing garbage",
+		input: mutate(func(b []byte) []byte {
+			b = append(b, 0)
+			binary.BigEndian.PutUint16(b[3:5], uint16(len(b)-5))
+			b[8]++ // handshake length
+			return b
+		}),
+		expect: ErrMalformed,
+	}, {
+		name: "short handshake",
+		input: mutate(func(b []byte) []byte {
+			b = b[:5+4+10]
+			binary.BigEndian.PutUint16(b[3:5], 14)
+			b[6], b[7], b[8] = 0, 0, 10
+			return b
+		}),
+		expect: ErrMalformed,
+	}}
+	for _, input := range inputs {
+		_, _, err := ReadClientHello(bytes.NewReader(input.input))
+		if !errors.Is(err, input.expect) {
+			t.Fatalf("%s: not the error we expected: %v", input.name, err)
+		}
+	}
+}
+
+func TestFingerprints(t *testing.T) {
+	hello := &ClientHello{
+		Version:      tls.VersionTLS12,
+		CipherSuites: []uint16{0x0a0a, 0x1302, 0x1301, 0xc02b},
+		Extensions: []Extension{
+			{Type: 0x1a1a}, {Type: extensionServerName}, {Type: extensionSupportedGroups},
+			{Type: extensionALPN}, {Type: extensionSupportedVersions},
+			{Type: extensionSignatureAlgs},
+		},
+		ALPN:                []string{"h2"},
+		SupportedVersions:   []uint16{0x2a2a, tls.VersionTLS13, tls.VersionTLS12},
+		SupportedGroups:     []uint16{0x3a3a, 29, 23},
+		ECPointFormats:      []byte{0},
+		SignatureAlgorithms: []uint16{0x0403, 0x0804},
+	}
+	ja3 := "771,4866-4865-49195,0-10-16-43-13,29-23,0"
+	if hello.JA3() != ja3 {
+		t.Fatal("unexpected JA3", hello.JA3())
+	}
+	sum := md5.Sum([]byte(ja3))
+	if hello.JA3Hash() != hex.EncodeToString(sum[:]) {
+		t.Fatal("unexpected JA3 hash")
+	}
+	ciphers := sha256.Sum256([]byte("1301,1302,c02b"))
+	extensions := sha256.Sum256([]byte("000a,000d,002b_0403,0804"))
+	ja4 := "t13d0305h2_" + hex.EncodeToString(ciphers[:])[:12] + "_" +
+		hex.EncodeToString(extensions[:])[:12]
+	if hello.JA4() != ja4 {
+		t.Fatal("unexpected JA4", hello.JA4())
+	}
+	hello = &ClientHello{Version: tls.VersionTLS11, ALPN: []string{"\x01x"}}
+	if hello.JA4() != "t11i000008_000000000000_000000000000" {
+		t.Fatal("unexpected JA4", hello.JA4())
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	raw := newClientHello(t, &tls.Config{ServerName: "www.example.com"})
+	hello, _, err := ReadClientHello(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(hello.Marshal(), raw) {
+		t.Fatal("Marshal does not round trip")
+	}
+	hello.Extensions = append(hello.Extensions, Extension{Type: extensionECH,
+		Data: bytes.Repeat([]byte{0xab}, 1<<15)})
+	ech, _, err := ReadClientHello(bytes.NewReader(hello.Marshal()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ech.HasECH() || ech.ServerName != "www.example.com" {
+		t.Fatal("unexpected ClientHello")
+	}
+	stripped := ech.WithoutExtensions(extensionECH, extensionESNI)
+	if stripped.HasECH() || !ech.HasECH() {
+		t.Fatal("WithoutExtensions did not copy the ClientHello")
+	}
+	if !bytes.Equal(stripped.Marshal(), raw) {
+		t.Fatal("unexpected stripped ClientHello")
+	}
+}
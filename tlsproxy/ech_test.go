@@ -0,0 +1,76 @@
+//go:build go1.24
+// +build go1.24
+
+package tlsproxy
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newECHKey creates an ECH key using X25519, HKDF-SHA256, and
+// AES-128-GCM and returns it along with its ECHConfigList.
+func newECHKey(t *testing.T) (tls.EncryptedClientHelloKey, []byte) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicName := "public.example.com"
+	contents := []byte{1}                     // config_id
+	contents = appendUint16(contents, 0x0020) // DHKEM(X25519, HKDF-SHA256)
+	contents = appendUint16(contents, uint16(len(key.PublicKey().Bytes())))
+	contents = append(contents, key.PublicKey().Bytes()...)
+	contents = appendUint16(contents, 4)
+	contents = appendUint16(contents, 0x0001) // HKDF-SHA256
+	contents = appendUint16(contents, 0x0001) // AES-128-GCM
+	contents = append(contents, 0)            // maximum_name_length
+	contents = append(contents, byte(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = appendUint16(contents, 0) // extensions
+	config := appendUint16(nil, extensionECH)
+	config = appendUint16(config, uint16(len(contents)))
+	config = append(config, contents...)
+	list := appendUint16(nil, uint16(len(config)))
+	list = append(list, config...)
+	return tls.EncryptedClientHelloKey{Config: config, PrivateKey: key.Bytes()}, list
+}
+
+func TestStripECH(t *testing.T) {
+	key, list := newECHKey(t)
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.TLS = &tls.Config{EncryptedClientHelloKeys: []tls.EncryptedClientHelloKey{key}}
+	server.StartTLS()
+	defer server.Close()
+	handshake := func(rules []string) (*tls.Conn, error) {
+		listener := newproxyTo(t, rules, server.Listener.Addr().String(), nil)
+		defer killproxy(t, listener)
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			EncryptedClientHelloConfigList: list,
+			InsecureSkipVerify:             true,
+			ServerName:                     "secret.example.com",
+		})
+		if err != nil {
+			return nil, err
+		}
+		conn.Close()
+		return conn, nil
+	}
+	// As a control, the handshake using ECH succeeds when we forward
+	// the ClientHello as is.
+	conn, err := handshake([]string{":ech:forward"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !conn.ConnectionState().ECHAccepted {
+		t.Fatal("expected the server to accept ECH")
+	}
+	// When we strip ECH, the server sees a ClientHello other than the one
+	// covered by the client's transcript, so the handshake fails.
+	if _, err := handshake([]string{":ech:strip"}); err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+}
@@ -0,0 +1,101 @@
+package tlsproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/google/martian/v3/mitm"
+)
+
+// replayConn is a net.Conn that replays the bytes we have already
+// read from the network before reading again from the network.
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func newReplayConn(conn net.Conn, incoming []byte) *replayConn {
+	return &replayConn{
+		Conn:   conn,
+		reader: io.MultiReader(bytes.NewReader(incoming), conn),
+	}
+}
+
+// Read implements net.Conn.Read.
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// newAuthority creates the CA signing the certificates used by
+// ActionMITM, which are generated on the fly for each SNI, as well as
+// the intermediate and the unknown CAs used by defective certificates.
+func (p *CensoringProxy) newAuthority() error {
+	cert, privkey, err := mitm.NewAuthority("jafar", "OONI", authorityValidity)
+	if err != nil {
+		return err
+	}
+	config, err := mitm.NewConfig(cert, privkey)
+	if err != nil {
+		return err
+	}
+	notBefore, notAfter := time.Now().Add(-24*time.Hour), time.Now().Add(authorityValidity)
+	intermediate, err := newSigner([]string{"jafar intermediate"}, notBefore,
+		notAfter, true, false, &signer{cert: cert, key: privkey})
+	if err != nil {
+		return err
+	}
+	unknownCA, err := newSigner([]string{"jafar unknown"}, notBefore,
+		notAfter, true, false, nil)
+	if err != nil {
+		return err
+	}
+	p.CA, p.authority = cert, config
+	p.intermediate, p.unknownCA = intermediate, unknownCA
+	p.certs = make(map[string]forgedCert)
+	return nil
+}
+
+// tlsConfig returns the TLS config ActionMITM uses for rule.
+func (p *CensoringProxy) tlsConfig(rule *Rule) *tls.Config {
+	if rule.Cert == "" {
+		return p.authority.TLS()
+	}
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return p.forge(hello.ServerName, rule.Cert)
+		},
+		NextProtos: []string{"http/1.1"},
+	}
+}
+
+// mitm completes the handshake with clientconn, which already sent us
+// incoming, and, if rule has a blockpage, replies with it.
+func (p *CensoringProxy) mitm(clientconn net.Conn, incoming []byte, rule *Rule) {
+	tlsconn := tls.Server(newReplayConn(clientconn, incoming), p.tlsConfig(rule))
+	defer tlsconn.Close()
+	if err := tlsconn.Handshake(); err != nil {
+		log.WithError(err).Warn("tlsproxy: tlsconn.Handshake failed")
+		return
+	}
+	if rule.Blockpage == "" {
+		return
+	}
+	req, err := http.ReadRequest(bufio.NewReader(tlsconn))
+	if err != nil {
+		log.WithError(err).Warn("tlsproxy: http.ReadRequest failed")
+		return
+	}
+	resp, err := p.Blockpages[rule.Blockpage].Render(req)
+	if err != nil {
+		log.WithError(err).Warn("tlsproxy: Render failed")
+		return
+	}
+	resp.Close = true
+	resp.Write(tlsconn)
+}
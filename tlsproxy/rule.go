@@ -0,0 +1,462 @@
+package tlsproxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ooni/jafar/internal/rulex"
+)
+
+const (
+	// ActionAlert is the action sending an alert and closing.
+	ActionAlert = "alert"
+
+	// ActionForward is the action forwarding the connection.
+	ActionForward = "forward"
+
+	// ActionEOF is the action closing the connection without an alert.
+	ActionEOF = "eof"
+
+	// ActionHang is the action dropping the traffic and hanging.
+	ActionHang = "hang"
+
+	// ActionMITM is the action completing the handshake using a forged
+	// certificate and optionally replying with a blockpage.
+	ActionMITM = "mitm"
+
+	// ActionReset is the action resetting the connection.
+	ActionReset = "rst"
+
+	// ActionStrip is the action removing the ECH and ESNI extensions
+	// from the ClientHello and forwarding it.
+	ActionStrip = "strip"
+)
+
+const (
+	// AlertInternalError is the default alert description.
+	AlertInternalError = 80
+
+	// AfterServerHello is the value of Rule.After meaning that the
+	// action occurs after forwarding the ServerHello.
+	AfterServerHello = -1
+)
+
+// alerts maps the names of the TLS alerts to their descriptions.
+var alerts = map[string]byte{
+	"close_notify":            0,
+	"unexpected_message":      10,
+	"bad_record_mac":          20,
+	"handshake_failure":       40,
+	"bad_certificate":         42,
+	"certificate_expired":     45,
+	"certificate_unknown":     46,
+	"illegal_parameter":       47,
+	"unknown_ca":              48,
+	"access_denied":           49,
+	"decode_error":            50,
+	"protocol_version":        70,
+	"insufficient_security":   71,
+	"internal_error":          AlertInternalError,
+	"inappropriate_fallback":  86,
+	"user_canceled":           90,
+	"unrecognized_name":       112,
+	"no_application_protocol": 120,
+}
+
+// versions maps the names of the TLS versions to their values.
+var versions = map[string]uint16{
+	"ssl3":   0x0300,
+	"tls1.0": 0x0301,
+	"tls1.1": 0x0302,
+	"tls1.2": 0x0303,
+	"tls1.3": 0x0304,
+}
+
+// Rule is a censorship rule. The rule matches a ClientHello when all the
+// nonzero fields of the rule match the ClientHello. Action is the action
+// to perform when the rule matches.
+type Rule struct {
+	Keyword    string   // matches SNIs containing it
+	JA3        string   // matches the JA3 hash
+	JA4        string   // matches the JA4 fingerprint or its prefix
+	ALPN       string   // matches ClientHellos offering this protocol
+	Version    uint16   // matches ClientHellos offering this version
+	Extensions []uint16 // match ClientHellos containing these extensions
+	ECH        bool     // matches ClientHellos using ECH or ESNI
+	NoSNI      bool     // matches ClientHellos without SNI
+	Action     string   // what to do if the rule matches
+
+	// Alert and AlertVersion are the description and the record
+	// version of the alert sent by ActionAlert.
+	Alert        byte
+	AlertVersion uint16
+
+	// After is the number of bytes sent by the server that we forward
+	// before performing the action, or AfterServerHello. When zero, we
+	// perform the action immediately after the ClientHello.
+	After int
+
+	// Blockpage is the name of the blockpage ActionMITM replies with
+	// to the first HTTP request. When empty, ActionMITM closes the
+	// connection right after the handshake.
+	Blockpage string
+
+	// Cert is the defect of the certificate used by ActionMITM (e.g.,
+	// CertExpired). When empty, the certificate is valid for the SNI
+	// and signed by the CA of the proxy.
+	Cert string
+
+	// Connect is the address where to forward the connection, with an
+	// optional port, instead of the SNI or the original destination.
+	Connect string
+
+	// Rate and UploadRate are the maximum number of bytes per second
+	// we forward from the server and from the client respectively, or
+	// zero. Delay is the delay of each chunk we forward.
+	Rate       int
+	UploadRate int
+	Delay      time.Duration
+
+	// MaxBytes and MaxTime, when nonzero, are the number of bytes we
+	// forward in both directions after the ClientHello and the time for
+	// which we forward before performing the action.
+	MaxBytes int64
+	MaxTime  time.Duration
+}
+
+// ParseRule parses a rule. The syntax is `keyword[:option...]` where
+// keyword matches the SNI, possibly empty to match any SNI, and the
+// options are the following. Note that, with ECH, the SNI is the outer
+// SNI, i.e., the public name of the client-facing server.
+//
+// - `ja3=HASH` matches the JA3 hash;
+//
+// - `ja4=FINGERPRINT` matches the JA4 fingerprint, or its prefix up to
+// an underscore (e.g., `t13d1516h2` or `t13d1516h2_8daaf6152771`);
+//
+// - `alpn=PROTOCOL` matches ClientHellos offering PROTOCOL;
+//
+// - `version=VERSION` matches ClientHellos offering VERSION, which is one
+// of `ssl3`, `tls1.0`, `tls1.1`, `tls1.2`, and `tls1.3`, or a number;
+//
+// - `ext=TYPE` matches ClientHellos containing the extension TYPE, which
+// is a number, and may be repeated;
+//
+// - `ech` matches ClientHellos containing the ECH or the ESNI extension;
+//
+// - `nosni` matches ClientHellos without SNI, and requires an empty keyword;
+//
+// - `alert[=ALERT[/VERSION]]` sends a fatal alert and closes (this is the
+// default action), where ALERT is the name of the alert, e.g.,
+// `handshake_failure`, or its number (default: `internal_error`) and
+// VERSION is the version of the alert record (default: `tls1.2`);
+//
+// - `eof` closes the connection without sending an alert;
+//
+// - `hang` drops the traffic and keeps the connection open until the
+// client closes it;
+//
+// - `rst` resets the connection;
+//
+// - `strip` removes the ECH and ESNI extensions from the ClientHello
+// and forwards it, which breaks the handshake like a real middlebox
+// stripping ECH does, because the client's transcript (and PSK binders)
+// cover the original ClientHello;
+//
+// - `forward` forwards the connection, which is useful to exempt some
+// ClientHellos from the rules that follow, or to use `connect`;
+//
+// - `connect=ADDRESS` forwards the connection to ADDRESS, i.e., a domain
+// name or an IP address optionally followed by a port (default: the
+// original port, or 443), and implies `forward` when there is no other
+// action (e.g., it may be used with `strip` and `after`);
+//
+// - `rate=DOWN[/UP]` throttles the connection using a token bucket to DOWN
+// bytes per second from the server and to UP bytes per second from the
+// client (default: DOWN), and implies `forward` when there is no other
+// action (e.g., it may be used either with `strip` or with `maxbytes`
+// and `maxtime`, but not with `after`);
+//
+// - `delay=DURATION` delays each chunk we forward by DURATION (e.g.,
+// `100ms`), and implies `forward` like `rate`;
+//
+// - `maxbytes=N` forwards the connection until we have forwarded N bytes
+// in both directions, not counting the ClientHello, and then performs
+// the action;
+//
+// - `maxtime=DURATION` forwards the connection for DURATION and then
+// performs the action, and may be used with `maxbytes`, but, like
+// `maxbytes`, not with `forward` and `strip`;
+//
+// - `mitm` completes the handshake using a certificate for the SNI signed
+// by the CA of the proxy, and then closes the connection;
+//
+// - `blockpage=NAME` implies `mitm` and replies to the first HTTP request
+// using the blockpage NAME (see httpproxy.Blockpages);
+//
+// - `cert=DEFECT` implies `mitm` and uses a certificate with DEFECT, which
+// is one of `expired`, `notyetvalid`, `wronghost`, `selfsigned`,
+// `unknownca`, `weakkey`, and `nointermediate`;
+//
+// - `after=N` forwards the ClientHello and N bytes sent by the server
+// before performing the action, while `after=serverhello` forwards the
+// ClientHello and the ServerHello before performing the action.
+//
+// Numbers are decimal, unless prefixed by `0x`. Keywords containing colons
+// or square brackets need escaping, as explained in package rulex.
+func ParseRule(s string) (*Rule, error) {
+	parsed, err := rulex.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	rule := &Rule{
+		Keyword:      parsed.Pattern,
+		Action:       ActionAlert,
+		Alert:        AlertInternalError,
+		AlertVersion: versions["tls1.2"],
+	}
+	var action string
+	setAction := func(name string) error {
+		if action != "" && action != name {
+			return fmt.Errorf("tlsproxy: conflicting actions in %q", s)
+		}
+		action = name
+		return nil
+	}
+	for _, option := range parsed.Options {
+		switch option.Name {
+		case "ja3":
+			rule.JA3 = strings.ToLower(option.Value)
+		case "ja4":
+			rule.JA4 = option.Value
+		case "alpn":
+			rule.ALPN = option.Value
+		case "version":
+			rule.Version, err = parseVersion(option.Value)
+		case "ext":
+			var ext uint16
+			ext, err = parseUint16(option.Value)
+			rule.Extensions = append(rule.Extensions, ext)
+		case "ech":
+			rule.ECH = true
+		case "nosni":
+			if rule.NoSNI = true; rule.Keyword != "" {
+				return nil, fmt.Errorf("tlsproxy: cannot use nosni with a keyword in %q", s)
+			}
+		case "connect":
+			if rule.Connect = option.Value; rule.Connect == "" {
+				return nil, fmt.Errorf("tlsproxy: empty connect address in %q", s)
+			}
+		case "rate":
+			rule.Rate, rule.UploadRate, err = parseRate(option.Value)
+		case "delay":
+			rule.Delay, err = time.ParseDuration(option.Value)
+			if err != nil || rule.Delay <= 0 {
+				return nil, fmt.Errorf("tlsproxy: invalid delay: %s", option.Value)
+			}
+		case "maxbytes":
+			rule.MaxBytes, err = strconv.ParseInt(option.Value, 10, 64)
+			if err != nil || rule.MaxBytes <= 0 {
+				return nil, fmt.Errorf("tlsproxy: invalid maxbytes: %s", option.Value)
+			}
+		case "maxtime":
+			rule.MaxTime, err = time.ParseDuration(option.Value)
+			if err != nil || rule.MaxTime <= 0 {
+				return nil, fmt.Errorf("tlsproxy: invalid maxtime: %s", option.Value)
+			}
+		case "after":
+			rule.After, err = parseAfter(option.Value)
+		case "blockpage":
+			rule.Blockpage = option.Value
+			err = setAction(ActionMITM)
+		case "cert":
+			rule.Cert = strings.ToLower(option.Value)
+			if !defects[rule.Cert] {
+				return nil, fmt.Errorf("tlsproxy: unknown certificate defect: %s", option.Value)
+			}
+			err = setAction(ActionMITM)
+		case ActionAlert:
+			if err = setAction(option.Name); err == nil && option.Value != "" {
+				rule.Alert, rule.AlertVersion, err = parseAlert(option.Value)
+			}
+		case ActionEOF, ActionForward, ActionHang, ActionMITM, ActionReset, ActionStrip:
+			err = setAction(option.Name)
+		default:
+			err = rulex.Unknown(option)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	shapes := rule.Rate > 0 || rule.Delay > 0
+	limits := rule.MaxBytes > 0 || rule.MaxTime > 0
+	if action == "" && (rule.Connect != "" || shapes) && !rule.delayed() {
+		action = ActionForward
+	}
+	if action != "" {
+		rule.Action = action
+	}
+	if rule.After != 0 && limits {
+		return nil, fmt.Errorf("tlsproxy: cannot use after with maxbytes or maxtime in %q", s)
+	}
+	if (rule.forwards() || rule.Action == ActionMITM) && rule.delayed() {
+		return nil, fmt.Errorf("tlsproxy: cannot use %s with after, maxbytes, or maxtime in %q",
+			rule.Action, s)
+	}
+	if rule.Connect != "" && !rule.forwards() && !rule.delayed() {
+		return nil, fmt.Errorf("tlsproxy: cannot use %s with connect in %q", rule.Action, s)
+	}
+	if shapes && !rule.forwards() && !limits {
+		return nil, fmt.Errorf("tlsproxy: cannot use %s with rate or delay in %q", rule.Action, s)
+	}
+	return rule, nil
+}
+
+// parseAlert parses the `ALERT[/VERSION]` value of the alert option.
+func parseAlert(s string) (byte, uint16, error) {
+	var (
+		name    = s
+		version = versions["tls1.2"]
+		err     error
+	)
+	if index := strings.Index(s, "/"); index >= 0 {
+		name = s[:index]
+		if version, err = parseVersion(s[index+1:]); err != nil {
+			return 0, 0, err
+		}
+	}
+	if alert, found := alerts[strings.ToLower(name)]; found {
+		return alert, version, nil
+	}
+	alert, err := strconv.ParseUint(name, 0, 8)
+	if err != nil {
+		return 0, 0, fmt.Errorf("tlsproxy: invalid alert: %s", name)
+	}
+	return byte(alert), version, nil
+}
+
+// parseRate parses the `DOWN[/UP]` value of the rate option.
+func parseRate(s string) (int, int, error) {
+	down, up := s, s
+	if index := strings.Index(s, "/"); index >= 0 {
+		down, up = s[:index], s[index+1:]
+	}
+	downRate, err := strconv.Atoi(down)
+	if err != nil || downRate <= 0 {
+		return 0, 0, fmt.Errorf("tlsproxy: invalid rate: %s", s)
+	}
+	upRate, err := strconv.Atoi(up)
+	if err != nil || upRate <= 0 {
+		return 0, 0, fmt.Errorf("tlsproxy: invalid rate: %s", s)
+	}
+	return downRate, upRate, nil
+}
+
+// parseAfter parses the value of the after option.
+func parseAfter(s string) (int, error) {
+	if strings.ToLower(s) == "serverhello" {
+		return AfterServerHello, nil
+	}
+	after, err := strconv.Atoi(s)
+	if err != nil || after <= 0 {
+		return 0, fmt.Errorf("tlsproxy: invalid after value: %s", s)
+	}
+	return after, nil
+}
+
+func parseVersion(s string) (uint16, error) {
+	if version, found := versions[strings.ToLower(s)]; found {
+		return version, nil
+	}
+	return parseUint16(s)
+}
+
+func parseUint16(s string) (uint16, error) {
+	v, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("tlsproxy: invalid number: %s", s)
+	}
+	return uint16(v), nil
+}
+
+// ParseRules is like ParseRule but parses a list of rules.
+func ParseRules(in []string) ([]*Rule, error) {
+	var out []*Rule
+	for _, s := range in {
+		rule, err := ParseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rule)
+	}
+	return out, nil
+}
+
+// delayed returns whether we perform the action of the rule only after
+// forwarding some traffic, i.e., when using after, maxbytes, or maxtime.
+func (rule *Rule) delayed() bool {
+	return rule.After != 0 || rule.MaxBytes > 0 || rule.MaxTime > 0
+}
+
+// forwards returns whether the action of the rule forwards the connection.
+func (rule *Rule) forwards() bool {
+	return rule.Action == ActionForward || rule.Action == ActionStrip
+}
+
+// match returns whether the rule matches hello.
+func (rule *Rule) match(hello *ClientHello) bool {
+	if !strings.Contains(hello.ServerName, rule.Keyword) {
+		return false
+	}
+	if rule.JA3 != "" && rule.JA3 != hello.JA3Hash() {
+		return false
+	}
+	if rule.JA4 != "" {
+		ja4 := hello.JA4()
+		if ja4 != rule.JA4 && !strings.HasPrefix(ja4, rule.JA4+"_") {
+			return false
+		}
+	}
+	if rule.ALPN != "" && !contains(hello.ALPN, rule.ALPN) {
+		return false
+	}
+	if rule.Version != 0 && !offersVersion(hello, rule.Version) {
+		return false
+	}
+	for _, ext := range rule.Extensions {
+		if !hello.HasExtension(ext) {
+			return false
+		}
+	}
+	if rule.ECH && !hello.HasECH() {
+		return false
+	}
+	if rule.NoSNI && hello.ServerName != "" {
+		return false
+	}
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// offersVersion returns whether hello offers version.
+func offersVersion(hello *ClientHello, version uint16) bool {
+	if len(hello.SupportedVersions) <= 0 {
+		return hello.Version == version
+	}
+	for _, v := range hello.SupportedVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
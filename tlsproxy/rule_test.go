@@ -0,0 +1,249 @@
+package tlsproxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/ooni/jafar/internal/rulex"
+)
+
+func TestParseRule(t *testing.T) {
+	rule, err := ParseRule(
+		"ooni.io:ja3=ABCDEF:ja4=t13d1516h2:alpn=h2:version=tls1.3:ext=0xfe0d:ext=43:rst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := &Rule{
+		Keyword:      "ooni.io",
+		JA3:          "abcdef",
+		JA4:          "t13d1516h2",
+		ALPN:         "h2",
+		Version:      0x0304,
+		Extensions:   []uint16{0xfe0d, 43},
+		Action:       ActionReset,
+		Alert:        AlertInternalError,
+		AlertVersion: 0x0303,
+	}
+	if diff := cmp.Diff(expect, rule); diff != "" {
+		t.Fatal(diff)
+	}
+	rule, err = ParseRule(":version=0x0303")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Keyword != "" || rule.Version != 0x0303 || rule.Action != ActionAlert {
+		t.Fatal("unexpected rule")
+	}
+	if rule.Alert != AlertInternalError || rule.AlertVersion != 0x0303 || rule.After != 0 {
+		t.Fatal("unexpected rule")
+	}
+}
+
+func TestParseRuleActions(t *testing.T) {
+	for _, tc := range []struct {
+		input        string
+		action       string
+		alert        byte
+		alertVersion uint16
+		after        int
+	}{
+		{"ooni.io:alert=handshake_failure", ActionAlert, 40, 0x0303, 0},
+		{"ooni.io:alert=Unrecognized_Name/tls1.0", ActionAlert, 112, 0x0301, 0},
+		{"ooni.io:alert=49/0x0304", ActionAlert, 49, 0x0304, 0},
+		{"ooni.io:eof", ActionEOF, AlertInternalError, 0x0303, 0},
+		{"ooni.io:hang:after=1024", ActionHang, AlertInternalError, 0x0303, 1024},
+		{"ooni.io:after=serverhello:rst", ActionReset, AlertInternalError, 0x0303, AfterServerHello},
+		{"ooni.io:mitm", ActionMITM, AlertInternalError, 0x0303, 0},
+		{"ooni.io:blockpage=451", ActionMITM, AlertInternalError, 0x0303, 0},
+		{"ooni.io:cert=Expired:mitm", ActionMITM, AlertInternalError, 0x0303, 0},
+		{"ooni.io:ech:strip", ActionStrip, AlertInternalError, 0x0303, 0},
+	} {
+		rule, err := ParseRule(tc.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rule.Action != tc.action || rule.Alert != tc.alert ||
+			rule.AlertVersion != tc.alertVersion || rule.After != tc.after {
+			t.Fatalf("unexpected rule for %s: %+v", tc.input, rule)
+		}
+	}
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	for _, input := range []string{
+		"ooni.io:version=tls9",
+		"ooni.io:ext=65536",
+		"ooni.io:ext=x",
+		"ooni.io:alert:rst",
+		"ooni.io:hang:eof",
+		"ooni.io:alert=antani",
+		"ooni.io:alert=256",
+		"ooni.io:alert=40/tls9",
+		"ooni.io:after=0",
+		"ooni.io:after=x",
+		"ooni.io:mitm:after=1",
+		"ooni.io:blockpage=451:rst",
+		"ooni.io:cert=antani",
+		"ooni.io:cert=expired:eof",
+		"ooni.io:strip:after=1",
+		"ooni.io:strip:rst",
+		"ooni.io:connect",
+		"ooni.io:connect=1.1.1.1:rst",
+		"ooni.io:forward:after=1",
+		"ooni.io:nosni",
+		"ooni.io:rate=0",
+		"ooni.io:rate=10/x",
+		"ooni.io:delay=x",
+		"ooni.io:delay=-1s",
+		"ooni.io:rate=1000:rst",
+		"ooni.io:delay=1s:after=10:rst",
+		"ooni.io:maxbytes=0",
+		"ooni.io:maxbytes=x",
+		"ooni.io:maxtime=0s",
+		"ooni.io:maxtime=x",
+		"ooni.io:maxbytes=10:after=10",
+		"ooni.io:maxtime=1s:forward",
+		"ooni.io:maxbytes=10:mitm",
+		"ooni.io:strip:maxbytes=10",
+		"[ooni.io",
+	} {
+		if _, err := ParseRule(input); err == nil {
+			t.Fatalf("expected an error for %s", input)
+		}
+	}
+}
+
+func TestParseRuleConnect(t *testing.T) {
+	for _, tc := range []struct {
+		input   string
+		action  string
+		connect string
+	}{
+		{"ooni.io:connect=1.1.1.1", ActionForward, "1.1.1.1"},
+		{"ooni.io:connect=[1.1.1.1:8443]:strip", ActionStrip, "1.1.1.1:8443"},
+		{"ooni.io:connect=[[::1]:8443]:after=10:rst", ActionReset, "[::1]:8443"},
+		{"ooni.io:forward", ActionForward, ""},
+	} {
+		rule, err := ParseRule(tc.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rule.Action != tc.action || rule.Connect != tc.connect {
+			t.Fatalf("unexpected rule for %s: %+v", tc.input, rule)
+		}
+	}
+}
+
+func TestParseRuleShaping(t *testing.T) {
+	rule, err := ParseRule("ooni.io:rate=1000/500:delay=100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Action != ActionForward || rule.Rate != 1000 || rule.UploadRate != 500 ||
+		rule.Delay != 100*time.Millisecond {
+		t.Fatalf("unexpected rule: %+v", rule)
+	}
+	rule, err = ParseRule("ooni.io:rate=1000:strip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Action != ActionStrip || rule.Rate != 1000 || rule.UploadRate != 1000 {
+		t.Fatalf("unexpected rule: %+v", rule)
+	}
+}
+
+func TestParseRuleLimits(t *testing.T) {
+	rule, err := ParseRule("ooni.io:maxbytes=1000:maxtime=5s:rate=100:connect=1.1.1.1:hang")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Action != ActionHang || rule.MaxBytes != 1000 || rule.MaxTime != 5*time.Second ||
+		rule.Rate != 100 || rule.Connect != "1.1.1.1" {
+		t.Fatalf("unexpected rule: %+v", rule)
+	}
+	rule, err = ParseRule("ooni.io:maxtime=5s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Action != ActionAlert {
+		t.Fatalf("unexpected rule: %+v", rule)
+	}
+}
+
+func TestParseRulesUnknownOption(t *testing.T) {
+	rules, err := ParseRules([]string{"ooni.io", "ooni.io:antani"})
+	if !errors.Is(err, rulex.ErrUnknownOption) {
+		t.Fatal("not the error we expected")
+	}
+	if rules != nil {
+		t.Fatal("expected nil rules here")
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	hello := &ClientHello{
+		Version:           0x0303,
+		CipherSuites:      []uint16{0x1301},
+		Extensions:        []Extension{{Type: extensionServerName}, {Type: extensionALPN}},
+		ServerName:        "www.example.com",
+		ALPN:              []string{"h2", "http/1.1"},
+		SupportedVersions: []uint16{0x0304, 0x0303},
+	}
+	ja4 := hello.JA4()
+	var inputs = []struct {
+		rule   string
+		expect bool
+	}{
+		{"example.com", true},
+		{"ooni.io", false},
+		{":ja3=" + hello.JA3Hash(), true},
+		{":ja3=00000000000000000000000000000000", false},
+		{":ja4=" + ja4, true},
+		{":ja4=" + ja4[:10], true},
+		{":ja4=" + ja4[:9], false},
+		{":alpn=http/1.1", true},
+		{":alpn=h3", false},
+		{":version=tls1.2", true},
+		{":version=tls1.1", false},
+		{":ext=0", true},
+		{":ext=0:ext=43", false},
+		{":ech", false},
+		{":nosni", false},
+	}
+	for _, input := range inputs {
+		rule, err := ParseRule(input.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rule.match(hello) != input.expect {
+			t.Fatalf("unexpected result for %s", input.rule)
+		}
+	}
+	// without supported_versions we use the legacy version
+	rule, err := ParseRule(":version=tls1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rule.match(&ClientHello{Version: 0x0303}) {
+		t.Fatal("expected the rule to match")
+	}
+	// the nosni option matches ClientHellos without SNI
+	rule, err = ParseRule(":nosni:rst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rule.match(&ClientHello{Version: 0x0303}) {
+		t.Fatal("expected the rule to match")
+	}
+	// the ech option also matches the ESNI draft extension
+	rule, err = ParseRule("public.example.com:ech")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rule.match(&ClientHello{ServerName: "public.example.com",
+		Extensions: []Extension{{Type: extensionESNI}}}) {
+		t.Fatal("expected the rule to match")
+	}
+}
@@ -0,0 +1,60 @@
+package tlsproxy
+
+import "time"
+
+// shaper shapes the traffic flowing in a direction of a connection. It
+// limits the rate using a token bucket, whose size is one second worth
+// of traffic, and delays each chunk of traffic.
+type shaper struct {
+	delay  time.Duration // delay of each chunk
+	rate   int           // bytes per second or zero
+	last   time.Time
+	now    func() time.Time
+	sleep  func(time.Duration)
+	tokens float64
+}
+
+// newShaper returns a shaper limiting the rate to the specified bytes
+// per second, unless zero, and delaying each chunk by delay. It returns
+// nil when there is no need to shape the traffic.
+func newShaper(rate int, delay time.Duration) *shaper {
+	if rate <= 0 && delay <= 0 {
+		return nil
+	}
+	return &shaper{
+		delay:  delay,
+		rate:   rate,
+		last:   time.Now(),
+		now:    time.Now,
+		sleep:  time.Sleep,
+		tokens: float64(rate),
+	}
+}
+
+// size returns the size of the next chunk, which is at most max and
+// at most the size of the bucket.
+func (s *shaper) size(max int) int {
+	if s.rate > 0 && s.rate < max {
+		return s.rate
+	}
+	return max
+}
+
+// wait waits until we can send a chunk of count bytes.
+func (s *shaper) wait(count int) {
+	if s.delay > 0 {
+		s.sleep(s.delay)
+	}
+	if s.rate <= 0 {
+		return
+	}
+	now := s.now()
+	s.tokens += now.Sub(s.last).Seconds() * float64(s.rate)
+	if s.tokens > float64(s.rate) {
+		s.tokens = float64(s.rate)
+	}
+	s.last = now
+	if s.tokens -= float64(count); s.tokens < 0 {
+		s.sleep(time.Duration(-s.tokens / float64(s.rate) * float64(time.Second)))
+	}
+}
@@ -0,0 +1,37 @@
+package tlsproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestShaper(t *testing.T) {
+	if newShaper(0, 0) != nil {
+		t.Fatal("expected nil shaper here")
+	}
+	shaper := newShaper(1000, 10*time.Millisecond)
+	now := shaper.last
+	var sleeps []time.Duration
+	shaper.now = func() time.Time { return now }
+	shaper.sleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+		now = now.Add(d)
+	}
+	if shaper.size(1<<18) != 1000 || shaper.size(500) != 500 {
+		t.Fatal("unexpected chunk size")
+	}
+	shaper.wait(1000) // the bucket is full
+	shaper.wait(500)  // the delay refills 10 bytes
+	now = now.Add(2 * time.Second)
+	shaper.wait(1000) // the bucket is full again
+	expect := []time.Duration{
+		10 * time.Millisecond,
+		10 * time.Millisecond, 490 * time.Millisecond,
+		10 * time.Millisecond,
+	}
+	if diff := cmp.Diff(expect, sleeps); diff != "" {
+		t.Fatal(diff)
+	}
+}
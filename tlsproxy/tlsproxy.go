@@ -3,70 +3,106 @@ package tlsproxy
 
 import (
 	"context"
-	"crypto/tls"
-	"errors"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 
 	"github.com/apex/log"
+	"github.com/google/martian/v3/mitm"
+	"github.com/ooni/jafar/httpproxy"
+	"github.com/ooni/jafar/internal/origdst"
 	"github.com/ooni/probe-engine/netx/httptransport"
 )
 
 // CensoringProxy is a censoring TLS proxy
 type CensoringProxy struct {
-	keywords []string
-	dial     func(network, address string) (net.Conn, error)
+	// Blockpages is the catalogue of blockpages that mitm rules may
+	// use. NewCensoringProxy initializes it using the default blockpages
+	// of the HTTP proxy.
+	Blockpages httpproxy.Blockpages
+
+	// CA is the certificate of the authority signing the certificates
+	// used by mitm rules. It is nil when no rule uses ActionMITM.
+	CA *x509.Certificate
+
+	// OriginalDst indicates whether to connect to the original
+	// destination of connections redirected to us using iptables,
+	// rather than to the address of the SNI.
+	OriginalDst bool
+
+	authority    *mitm.Config
+	certs        map[string]forgedCert
+	dial         func(network, address string) (net.Conn, error)
+	intermediate *signer
+	mu           sync.Mutex
+	rules        []*Rule
+	unknownCA    *signer
 }
 
 // NewCensoringProxy creates a new CensoringProxy instance using
-// the specified list of keywords to censor. keywords is the list
-// of keywords that trigger censorship if any of them appears in
-// the SNII record of a ClientHello. dnsNetwork and dnsAddress are
-// settings to configure the upstream, non censored DNS.
+// the specified list of rules (see ParseRule). In its simplest form,
+// a rule is a keyword that triggers censorship if it appears in the
+// SNI of a ClientHello. uncensored is the upstream, non censored
+// dialer we use to connect to the servers. When any rule uses
+// ActionMITM, we also create the CA signing the forged certificates.
 func NewCensoringProxy(
-	keywords []string, uncensored httptransport.Dialer,
-) *CensoringProxy {
-	return &CensoringProxy{
-		keywords: keywords,
+	rules []string, uncensored httptransport.Dialer,
+) (*CensoringProxy, error) {
+	parsed, err := ParseRules(rules)
+	if err != nil {
+		return nil, err
+	}
+	p := &CensoringProxy{
+		Blockpages: httpproxy.DefaultBlockpages(),
+		rules:      parsed,
 		dial: func(network, address string) (net.Conn, error) {
 			return uncensored.DialContext(context.Background(), network, address)
 		},
 	}
-}
-
-// handshakeReader is a hack to perform the initial part of the
-// TLS handshake so to know the SNI and then replay the bytes of
-// this initial part of the handshake with the server.
-type handshakeReader struct {
-	net.Conn
-	incoming []byte
-}
-
-// Read saves the initial bytes of the handshake such that later
-// we can replay the handshake with the real TLS server.
-func (c *handshakeReader) Read(b []byte) (int, error) {
-	count, err := c.Conn.Read(b)
-	if err == nil {
-		c.incoming = append(c.incoming, b[:count]...)
+	for _, rule := range parsed {
+		if rule.Action == ActionMITM {
+			if err := p.newAuthority(); err != nil {
+				return nil, err
+			}
+			break
+		}
 	}
-	return count, err
+	return p, nil
 }
 
-// Write prevents writing on the real connection
-func (c *handshakeReader) Write(b []byte) (int, error) {
-	return 0, errors.New("cannot write on this connection")
-}
-
-// forward forwards left traffic to right
-func forward(wg *sync.WaitGroup, left, right net.Conn) {
+// forward forwards left traffic to right using shaper, if not nil, and
+// stops once the traffic exceeds budget, if not nil
+func forward(wg *sync.WaitGroup, left, right net.Conn, shaper *shaper, budget *budget) {
 	data := make([]byte, 1<<18)
 	for {
-		n, err := left.Read(data)
+		buf := data
+		if shaper != nil {
+			buf = data[:shaper.size(len(data))]
+		}
+		n, err := left.Read(buf)
 		if err != nil {
 			break
 		}
-		if _, err = right.Write(data[:n]); err != nil {
+		if shaper != nil {
+			shaper.wait(n)
+		}
+		var last bool
+		if budget != nil {
+			if n, last = budget.spend(n); n <= 0 {
+				break
+			}
+		}
+		_, err = right.Write(data[:n])
+		if last {
+			budget.exceed()
+		}
+		if err != nil || last {
 			break
 		}
 	}
@@ -81,39 +117,104 @@ func reset(conn net.Conn) {
 	conn.Close()
 }
 
-// alertclose sends a TLS alert and then closes the connection
-func alertclose(conn net.Conn) {
+// alertclose sends a fatal TLS alert with the specified description
+// inside a record with the specified version and then closes the connection
+func alertclose(conn net.Conn, description byte, version uint16) {
 	alertdata := []byte{
-		21, // alert
-		3,  // version[0]
-		3,  // version[1]
-		0,  // length[0]
-		2,  // length[1]
-		2,  // fatal
-		80, // internal error
+		21,                 // alert
+		byte(version >> 8), // version[0]
+		byte(version),      // version[1]
+		0,                  // length[0]
+		2,                  // length[1]
+		2,                  // fatal
+		description,
 	}
 	conn.Write(alertdata)
 	conn.Close()
 }
 
-// getsni attempts the handshakeReader hack to obtain the SNI by reading
-// the beginning of the TLS handshake. On success a nonempty SNI string
-// is returned. Otherwise we cannot distinguish between the absence of a
-// SNI and any other reading network error that may have occurred.
-func getsni(conn *handshakeReader) string {
-	var (
-		sni   string
-		mutex sync.Mutex // just for safety
-	)
-	tls.Server(conn, &tls.Config{
-		GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			mutex.Lock()
-			sni = info.ServerName
-			mutex.Unlock()
-			return nil, errors.New("tlsproxy: we can't really continue handshake")
-		},
-	}).Handshake()
-	return sni
+// match returns the first rule matching hello or nil.
+func (p *CensoringProxy) match(hello *ClientHello) *Rule {
+	for _, rule := range p.rules {
+		if rule.match(hello) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// censor performs the action of rule on conn, which sent us incoming.
+func (p *CensoringProxy) censor(conn net.Conn, incoming []byte, rule *Rule) {
+	switch rule.Action {
+	case ActionReset:
+		reset(conn)
+	case ActionEOF:
+		conn.Close()
+	case ActionHang:
+		// Read and discard until the client gives up
+		io.Copy(ioutil.Discard, conn)
+		conn.Close()
+	case ActionMITM:
+		p.mitm(conn, incoming, rule)
+	default:
+		alertclose(conn, rule.Alert, rule.AlertVersion)
+	}
+}
+
+// censorAfter forwards traffic between clientconn and serverconn until
+// the server has sent what rule.After specifies and then performs the
+// action of rule on clientconn.
+func (p *CensoringProxy) censorAfter(clientconn, serverconn net.Conn, rule *Rule) {
+	done := make(chan bool, 1)
+	go func() {
+		io.Copy(serverconn, clientconn)
+		// Keep reading once serverconn is closed, so we can hang
+		io.Copy(ioutil.Discard, clientconn)
+		done <- true
+	}()
+	var err error
+	if rule.After == AfterServerHello {
+		err = forwardServerHello(clientconn, serverconn)
+	} else {
+		_, err = io.CopyN(clientconn, serverconn, int64(rule.After))
+	}
+	serverconn.Close()
+	switch {
+	case err != nil:
+		clientconn.Close()
+	case rule.Action == ActionHang:
+		// Wait for the client to give up
+	default:
+		p.censor(clientconn, nil, rule)
+	}
+	<-done
+	clientconn.Close()
+}
+
+// forwardServerHello forwards the records sent by the server up to
+// the one containing the ServerHello.
+func forwardServerHello(clientconn, serverconn net.Conn) error {
+	for {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(serverconn, header); err != nil {
+			return err
+		}
+		length := int(binary.BigEndian.Uint16(header[3:]))
+		if length > maxRecordLength {
+			return ErrMalformed
+		}
+		record := append(header, make([]byte, length)...)
+		if _, err := io.ReadFull(serverconn, record[5:]); err != nil {
+			return err
+		}
+		if _, err := clientconn.Write(record); err != nil {
+			return err
+		}
+		if record[0] == recordTypeHandshake && length > 0 &&
+			record[5] == handshakeTypeServerHello {
+			return nil
+		}
+	}
 }
 
 func (p *CensoringProxy) connectingToMyself(conn net.Conn) bool {
@@ -124,48 +225,136 @@ func (p *CensoringProxy) connectingToMyself(conn net.Conn) bool {
 	return localErr != nil || remoteErr != nil || localAddr == remoteAddr
 }
 
+// destination returns the address where to forward clientconn, which
+// sent a ClientHello for sni matching rule, possibly nil. We use, in
+// order of preference, the rule's connect address, the original
+// destination if p.OriginalDst or sni is empty, and the SNI. Unless the
+// rule's connect address has a port, we use the original port, or 443.
+// We return an empty string when we do not know where to forward.
+func (p *CensoringProxy) destination(clientconn net.Conn, sni string, rule *Rule) string {
+	addr, err := origdst.Get(clientconn)
+	if err != nil && (p.OriginalDst || sni == "") {
+		log.WithError(err).Warn("tlsproxy: origdst.Get failed")
+	}
+	port := "443"
+	if err == nil {
+		port = strconv.Itoa(addr.Port)
+	}
+	switch {
+	case rule != nil && rule.Connect != "":
+		if _, _, err := net.SplitHostPort(rule.Connect); err == nil {
+			return rule.Connect
+		}
+		return net.JoinHostPort(strings.Trim(rule.Connect, "[]"), port)
+	case (p.OriginalDst || sni == "") && err == nil:
+		return addr.String()
+	case sni == "":
+		return ""
+	default:
+		return net.JoinHostPort(sni, port)
+	}
+}
+
 // handle implements the TLS SNI proxy
 func (p *CensoringProxy) handle(clientconn net.Conn) {
-	hr := &handshakeReader{Conn: clientconn}
-	sni := getsni(hr)
-	if sni == "" {
-		log.Warn("tlsproxy: network failure or SNI not provided")
+	hello, incoming, err := ReadClientHello(clientconn)
+	if err != nil {
+		log.WithError(err).Warn("tlsproxy: ReadClientHello failed")
 		reset(clientconn)
 		return
 	}
-	for _, pattern := range p.keywords {
-		if strings.Contains(sni, pattern) {
-			log.Warnf("tlsproxy: reject SNI by policy: %s", sni)
-			alertclose(clientconn)
-			return
-		}
+	log.Debugf("tlsproxy: ClientHello: sni=%s alpn=%v ech=%v ja3=%s ja4=%s",
+		hello.ServerName, hello.ALPN, hello.HasECH(), hello.JA3Hash(), hello.JA4())
+	sni := hello.ServerName
+	rule := p.match(hello)
+	if rule != nil && rule.Action == ActionStrip && hello.HasECH() {
+		log.Infof("tlsproxy: strip ECH from ClientHello: %s", sni)
+		incoming = hello.WithoutExtensions(extensionECH, extensionESNI).Marshal()
+	}
+	if rule != nil && !rule.forwards() && !rule.delayed() {
+		log.Warnf("tlsproxy: reject ClientHello by policy: %s", sni)
+		p.censor(clientconn, incoming, rule)
+		return
 	}
-	serverconn, err := p.dial("tcp", net.JoinHostPort(sni, "443"))
+	if rule != nil && rule.delayed() {
+		log.Warnf("tlsproxy: forward ClientHello and censor later by policy: %s", sni)
+	}
+	address := p.destination(clientconn, sni, rule)
+	if address == "" {
+		log.Warn("tlsproxy: SNI not provided and connection not redirected")
+		alertclose(clientconn, AlertInternalError, versions["tls1.2"])
+		return
+	}
+	serverconn, err := p.dial("tcp", address)
 	if err != nil {
 		log.WithError(err).Warn("tlsproxy: p.dial failed")
-		alertclose(clientconn)
+		alertclose(clientconn, AlertInternalError, versions["tls1.2"])
 		return
 	}
 	if p.connectingToMyself(serverconn) {
 		log.Warn("tlsproxy: connecting to myself")
-		alertclose(clientconn)
+		alertclose(clientconn, AlertInternalError, versions["tls1.2"])
 		return
 	}
-	if _, err := serverconn.Write(hr.incoming); err != nil {
+	if _, err := serverconn.Write(incoming); err != nil {
 		log.WithError(err).Warn("tlsproxy: serverconn.Write failed")
-		alertclose(clientconn)
+		alertclose(clientconn, AlertInternalError, versions["tls1.2"])
+		return
+	}
+	if rule != nil && rule.After != 0 {
+		p.censorAfter(clientconn, serverconn, rule)
 		return
 	}
-	log.Infof("tlsproxy: routing for %s", sni)
+	log.Infof("tlsproxy: routing for %s to %s", sni, address)
 	defer clientconn.Close()
 	defer serverconn.Close()
+	var (
+		upload, download *shaper
+		limit            *budget
+	)
+	if rule != nil {
+		upload = newShaper(rule.UploadRate, rule.Delay)
+		download = newShaper(rule.Rate, rule.Delay)
+	}
+	if rule != nil && rule.delayed() {
+		limit = newBudget(rule.MaxBytes, rule.MaxTime)
+		defer limit.stop()
+	}
 	var wg sync.WaitGroup
 	wg.Add(2)
-	go forward(&wg, clientconn, serverconn)
-	go forward(&wg, serverconn, clientconn)
+	go forward(&wg, clientconn, serverconn, upload, limit)
+	go forward(&wg, serverconn, clientconn, download, limit)
+	if limit != nil {
+		p.censorExceeded(clientconn, serverconn, rule, limit, &wg)
+	}
 	wg.Wait()
 }
 
+// censorExceeded waits until either the traffic exceeds limit, in which
+// case it performs the action of rule on clientconn, or we are done
+// forwarding, as signalled by wg.
+func (p *CensoringProxy) censorExceeded(
+	clientconn, serverconn net.Conn, rule *Rule, limit *budget, wg *sync.WaitGroup,
+) {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-limit.exceeded:
+	case <-done:
+		return
+	}
+	log.Infof("tlsproxy: connection exceeded the limits of the rule")
+	serverconn.Close()
+	if rule.Action == ActionHang {
+		// Forwarding stops once the client sends more data
+		<-done
+	}
+	p.censor(clientconn, nil, rule)
+}
+
 func (p *CensoringProxy) run(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
@@ -181,8 +370,14 @@ func (p *CensoringProxy) run(listener net.Listener) {
 	}
 }
 
-// Start starts the censoring proxy.
+// Start starts the censoring proxy. It fails if any rule refers to
+// a blockpage that is not in p.Blockpages.
 func (p *CensoringProxy) Start(address string) (net.Listener, error) {
+	for _, rule := range p.rules {
+		if _, found := p.Blockpages[rule.Blockpage]; rule.Blockpage != "" && !found {
+			return nil, fmt.Errorf("tlsproxy: unknown blockpage: %s", rule.Blockpage)
+		}
+	}
 	listener, err := net.Listen("tcp", address)
 	if err != nil {
 		return nil, err
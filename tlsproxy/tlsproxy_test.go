@@ -1,11 +1,21 @@
 package tlsproxy
 
 import (
+	"bufio"
+	"crypto/rsa"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/ooni/jafar/uncensored"
 )
@@ -93,9 +103,12 @@ func TestFailWriteAfterConnect(t *testing.T) {
 }
 
 func TestIntegrationListenError(t *testing.T) {
-	proxy := NewCensoringProxy(
+	proxy, err := NewCensoringProxy(
 		[]string{""}, uncensored.DefaultClient,
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
 	listener, err := proxy.Start("8.8.8.8:80")
 	if err == nil {
 		t.Fatal("expected an error here")
@@ -105,10 +118,444 @@ func TestIntegrationListenError(t *testing.T) {
 	}
 }
 
+func TestFingerprintRules(t *testing.T) {
+	proxy, err := NewCensoringProxy([]string{
+		":alpn=tor:rst",
+		":version=tls1.3:alert",
+	}, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.dial = func(network, address string) (net.Conn, error) {
+		return nil, errors.New("mocked error")
+	}
+	listener, err := proxy.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer killproxy(t, listener)
+	dial := func(config *tls.Config) error {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	err = dial(&tls.Config{ServerName: "www.example.com", NextProtos: []string{"tor"}})
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatal("not the error we expected", err)
+	}
+	err = dial(&tls.Config{ServerName: "www.example.com", MaxVersion: tls.VersionTLS13})
+	if err == nil || err.Error() != "remote error: tls: internal error" {
+		t.Fatal("not the error we expected", err)
+	}
+}
+
+func TestActions(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	listener := newproxyTo(t, []string{
+		"alert.local:alert=unrecognized_name",
+		"eof.local:eof",
+		"hang.local:hang",
+		"rst.local:after=1:rst",
+		"serverhello.local:after=serverhello:eof",
+	}, server.Listener.Addr().String(), nil)
+	defer killproxy(t, listener)
+	dial := func(sni string) error {
+		dialer := &net.Dialer{Timeout: 500 * time.Millisecond}
+		conn, err := tls.DialWithDialer(dialer, "tcp", listener.Addr().String(),
+			&tls.Config{ServerName: sni, InsecureSkipVerify: true})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	if err := dial("pass.local"); err != nil {
+		t.Fatal(err)
+	}
+	err := dial("alert.local")
+	if err == nil || err.Error() != "remote error: tls: unrecognized name" {
+		t.Fatal("not the error we expected", err)
+	}
+	if err := dial("eof.local"); !errors.Is(err, io.EOF) {
+		t.Fatal("not the error we expected", err)
+	}
+	var neterr net.Error
+	if err := dial("hang.local"); !errors.As(err, &neterr) || !neterr.Timeout() {
+		t.Fatal("not the error we expected", err)
+	}
+	if err := dial("rst.local"); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatal("not the error we expected", err)
+	}
+	err = dial("serverhello.local")
+	if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatal("not the error we expected", err)
+	}
+}
+
+func TestMITM(t *testing.T) {
+	proxy, err := NewCensoringProxy([]string{
+		"blocked.local:blockpage=451",
+		"mitm.local:mitm",
+	}, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy.CA == nil {
+		t.Fatal("expected a CA here")
+	}
+	listener, err := proxy.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer killproxy(t, listener)
+	roots := x509.NewCertPool()
+	roots.AddCert(proxy.CA)
+	dial := func(sni string) *tls.Conn {
+		conn, err := tls.Dial("tcp", listener.Addr().String(),
+			&tls.Config{ServerName: sni, RootCAs: roots})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	conn := dial("blocked.local")
+	defer conn.Close()
+	if _, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: blocked.local\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnavailableForLegalReasons {
+		t.Fatal("unexpected status code", resp.StatusCode)
+	}
+	conn = dial("mitm.local")
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatal("not the error we expected", err)
+	}
+}
+
+func TestMITMCertificateDefects(t *testing.T) {
+	var rules []string
+	for defect := range defects {
+		rules = append(rules, defect+".local:cert="+defect)
+	}
+	proxy, err := NewCensoringProxy(rules, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := proxy.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer killproxy(t, listener)
+	roots := x509.NewCertPool()
+	roots.AddCert(proxy.CA)
+	dial := func(sni string) error {
+		conn, err := tls.Dial("tcp", listener.Addr().String(),
+			&tls.Config{ServerName: sni, RootCAs: roots})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	var (
+		invalid  x509.CertificateInvalidError
+		hostname x509.HostnameError
+		unknown  x509.UnknownAuthorityError
+	)
+	for _, tc := range []struct {
+		defect string
+		check  func(err error) bool
+	}{
+		{CertExpired, func(err error) bool {
+			return errors.As(err, &invalid) && invalid.Reason == x509.Expired
+		}},
+		{CertNotYetValid, func(err error) bool {
+			return errors.As(err, &invalid) && invalid.Reason == x509.Expired
+		}},
+		{CertWrongHost, func(err error) bool {
+			return errors.As(err, &hostname)
+		}},
+		{CertSelfSigned, func(err error) bool {
+			return errors.As(err, &unknown)
+		}},
+		{CertUnknownCA, func(err error) bool {
+			return errors.As(err, &unknown)
+		}},
+		{CertNoIntermediate, func(err error) bool {
+			return errors.As(err, &unknown)
+		}},
+	} {
+		if err := dial(tc.defect + ".local"); !tc.check(err) {
+			t.Fatal("not the error we expected", tc.defect, err)
+		}
+	}
+	conn, err := tls.Dial("tcp", listener.Addr().String(),
+		&tls.Config{ServerName: "weakkey.local", RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	key, ok := conn.ConnectionState().PeerCertificates[0].PublicKey.(*rsa.PublicKey)
+	if !ok || key.N.BitLen() != 1024 {
+		t.Fatal("expected a 1024 bit RSA key")
+	}
+}
+
+func TestForgeRefresh(t *testing.T) {
+	proxy, err := NewCensoringProxy([]string{"x.local:mitm"}, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy.CA.NotAfter.Before(time.Now().Add(365 * 24 * time.Hour)) {
+		t.Fatal("the CA expires too soon")
+	}
+	first, err := proxy.forge("x.local", CertExpired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := proxy.forge("x.local", CertExpired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Fatal("expected to reuse the certificate")
+	}
+	forged := proxy.certs["x.local/"+CertExpired]
+	forged.refresh = time.Now().Add(-time.Second)
+	proxy.certs["x.local/"+CertExpired] = forged
+	third, err := proxy.forge("x.local", CertExpired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == first || !third.Leaf.NotAfter.Before(time.Now()) {
+		t.Fatal("expected a new expired certificate")
+	}
+}
+
+func TestMITMUnknownBlockpage(t *testing.T) {
+	proxy, err := NewCensoringProxy([]string{"ooni.io:blockpage=antani"},
+		uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := proxy.Start("127.0.0.1:0")
+	if err == nil || err.Error() != "tlsproxy: unknown blockpage: antani" {
+		t.Fatal("not the error we expected", err)
+	}
+	if listener != nil {
+		t.Fatal("expected nil listener here")
+	}
+}
+
+func TestConnect(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	addresses := make(chan string, 1)
+	listener := newproxyTo(t, []string{
+		"fronted.local:connect=www.example.org",
+		"ipv6.local:connect=[::1]",
+		"port.local:connect=[10.0.0.1:8443]",
+		"forward.local:forward",
+		":rst",
+	}, server.Listener.Addr().String(), addresses)
+	defer killproxy(t, listener)
+	for _, tc := range []struct {
+		sni     string
+		address string
+	}{
+		{"fronted.local", "www.example.org:443"},
+		{"ipv6.local", "[::1]:443"},
+		{"port.local", "10.0.0.1:8443"},
+		{"forward.local", "forward.local:443"},
+	} {
+		conn, err := tls.Dial("tcp", listener.Addr().String(),
+			&tls.Config{ServerName: tc.sni, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if address := <-addresses; address != tc.address {
+			t.Fatal("unexpected address", address)
+		}
+	}
+	_, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{ServerName: "other.local"})
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatal("not the error we expected", err)
+	}
+}
+
+func TestNoSNI(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	dial := func(rule string) error {
+		listener := newproxyTo(t, []string{rule}, server.Listener.Addr().String(), nil)
+		defer killproxy(t, listener)
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+		})
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	if err := dial(":nosni:connect=[127.0.0.1]"); err != nil {
+		t.Fatal(err)
+	}
+	err := dial(":nosni:alert=handshake_failure")
+	if err == nil || err.Error() != "remote error: tls: handshake failure" {
+		t.Fatal("not the error we expected", err)
+	}
+	// without a rule we cannot know where to forward
+	err = dial("ooni.io")
+	if err == nil || err.Error() != "remote error: tls: internal error" {
+		t.Fatal("not the error we expected", err)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	const rate, size = 100000, 150000
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, _, err := ReadClientHello(conn); err == nil {
+			conn.Write(make([]byte, size))
+		}
+	}()
+	listener := newproxyTo(t, []string{"slow.local:rate=" + strconv.Itoa(rate)}, server.Addr().String(), nil)
+	defer killproxy(t, listener)
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	if _, err := conn.Write(newClientHello(t, &tls.Config{ServerName: "slow.local"})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	// the bucket is initially full, so we wait for the remaining bytes
+	if elapsed := time.Since(start); elapsed < (size-rate)*time.Second/rate*9/10 {
+		t.Fatal("the connection was not throttled", elapsed)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if hello, _, err := ReadClientHello(conn); err == nil &&
+					hello.ServerName == "bytes.local" {
+					conn.Write(make([]byte, 1000))
+				}
+				io.Copy(ioutil.Discard, conn)
+			}()
+		}
+	}()
+	listener := newproxyTo(t, []string{
+		"bytes.local:maxbytes=10:eof",
+		"time.local:maxtime=100ms:rst",
+		"hang.local:maxtime=100ms:hang",
+	}, server.Addr().String(), nil)
+	defer killproxy(t, listener)
+	dial := func(hello []byte) net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write(hello); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	conn := dial(newClientHello(t, &tls.Config{ServerName: "bytes.local"}))
+	defer conn.Close()
+	data, err := ioutil.ReadAll(conn)
+	if err != nil || len(data) != 10 {
+		t.Fatal("unexpected result", len(data), err)
+	}
+	conn = dial(newClientHello(t, &tls.Config{ServerName: "time.local"}))
+	defer conn.Close()
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatal("not the error we expected", err)
+	}
+	conn = dial(newClientHello(t, &tls.Config{ServerName: "hang.local"}))
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(500 * time.Millisecond))
+	var neterr net.Error
+	if _, err := conn.Read(make([]byte, 1)); !errors.As(err, &neterr) || !neterr.Timeout() {
+		t.Fatal("not the error we expected", err)
+	}
+}
+
+func TestNewCensoringProxyInvalidRule(t *testing.T) {
+	proxy, err := NewCensoringProxy([]string{"ooni.io:ext=x"}, uncensored.DefaultClient)
+	if err == nil {
+		t.Fatal("expected an error here")
+	}
+	if proxy != nil {
+		t.Fatal("expected nil proxy here")
+	}
+}
+
 func newproxy(t *testing.T, blocked string) net.Listener {
-	proxy := NewCensoringProxy(
+	proxy, err := NewCensoringProxy(
 		[]string{blocked}, uncensored.DefaultClient,
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := proxy.Start("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener
+}
+
+// newproxyTo is like newproxy but forwards all the connections to
+// upstream and, when dialed is not nil, sends the addresses the proxy
+// would have dialed to it.
+func newproxyTo(t *testing.T, rules []string, upstream string, dialed chan<- string) net.Listener {
+	proxy, err := NewCensoringProxy(rules, uncensored.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.dial = func(network, address string) (net.Conn, error) {
+		if dialed != nil {
+			dialed <- address
+		}
+		conn, err := net.Dial(network, upstream)
+		if err != nil {
+			return nil, err
+		}
+		return &mockedConnRemoteAddr{Conn: conn}, nil
+	}
 	listener, err := proxy.Start("127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
@@ -166,10 +613,20 @@ func (c *mockedConnWriteError) RemoteAddr() net.Addr {
 	}
 }
 
+// mockedConnRemoteAddr prevents connectingToMyself from
+// failing when the server is listening on the loopback.
+type mockedConnRemoteAddr struct {
+	net.Conn
+}
+
+func (c *mockedConnRemoteAddr) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}
+}
+
 func TestForwardWriteError(t *testing.T) {
 	var wg sync.WaitGroup
 	wg.Add(1)
-	forward(&wg, &mockedConnReadOkay{}, &mockedConnWriteError{})
+	forward(&wg, &mockedConnReadOkay{}, &mockedConnWriteError{}, nil, nil)
 }
 
 type mockedConnReadOkay struct {
@@ -4,13 +4,16 @@ package uncensored
 
 import (
 	"context"
+	"errors"
 	"net"
 	"net/http"
 
 	"github.com/apex/log"
+	"github.com/miekg/dns"
 	"github.com/ooni/jafar/internal/runtimex"
 	"github.com/ooni/probe-engine/experiment/urlgetter"
 	"github.com/ooni/probe-engine/netx/httptransport"
+	"github.com/ooni/probe-engine/netx/resolver"
 )
 
 // Client is DNS, HTTP, and TCP client.
@@ -65,6 +68,55 @@ func (c *Client) Network() string {
 	return c.dnsClient.Network()
 }
 
+// ErrCannotExchange indicates that the resolver does not allow us to
+// exchange DNS messages, which is the case of the system resolver.
+var ErrCannotExchange = errors.New("uncensored: cannot exchange DNS messages")
+
+// transporter is a resolver using a DNS transport.
+type transporter interface {
+	Transport() resolver.RoundTripper
+}
+
+// CanExchange returns whether we can use Exchange.
+func (c *Client) CanExchange() bool {
+	_, ok := c.dnsClient.Resolver.(transporter)
+	return ok
+}
+
+// Exchange sends query to the resolver and returns the reply, which,
+// unlike LookupHost, tells us the TTL of the answers. It fails with
+// ErrCannotExchange unless CanExchange returns true.
+func (c *Client) Exchange(ctx context.Context, query *dns.Msg) (*dns.Msg, error) {
+	t, ok := c.dnsClient.Resolver.(transporter)
+	if !ok {
+		return nil, ErrCannotExchange
+	}
+	txp := t.Transport()
+	if txp.RequiresPadding() {
+		// RFC 8467 recommends padding queries to a multiple of 128 bytes
+		query = query.Copy()
+		query.SetEdns0(1232, false)
+		opt := query.IsEdns0()
+		size := query.Len() + 4 // option code and length
+		opt.Option = append(opt.Option, &dns.EDNS0_PADDING{
+			Padding: make([]byte, (128-size%128)%128),
+		})
+	}
+	data, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	data, err = txp.RoundTrip(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+	reply := new(dns.Msg)
+	if err := reply.Unpack(data); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
 var _ httptransport.Dialer = DefaultClient
 
 // DialContext implements httptransport.Dialer.DialContext
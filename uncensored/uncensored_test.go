@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"context"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"testing"
+
+	"github.com/miekg/dns"
 )
 
 func TestIntegration(t *testing.T) {
@@ -73,3 +76,44 @@ func TestNewClientFailure(t *testing.T) {
 		t.Fatal("expected nil client here")
 	}
 }
+
+func TestExchange(t *testing.T) {
+	pconn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{
+		PacketConn: pconn,
+		Handler: dns.HandlerFunc(func(rw dns.ResponseWriter, req *dns.Msg) {
+			reply := new(dns.Msg)
+			reply.SetReply(req)
+			rr, _ := dns.NewRR("example.com. 42 IN A 93.184.216.34")
+			reply.Answer = append(reply.Answer, rr)
+			rw.WriteMsg(reply)
+		}),
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	client, err := NewClient("udp://" + pconn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !client.CanExchange() {
+		t.Fatal("expected to be able to exchange messages")
+	}
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	reply, err := client.Exchange(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Answer) != 1 || reply.Answer[0].Header().Ttl != 42 {
+		t.Fatal("unexpected reply")
+	}
+	if DefaultClient.CanExchange() {
+		t.Fatal("expected the system resolver not to exchange messages")
+	}
+	if _, err := DefaultClient.Exchange(context.Background(), query); err != ErrCannotExchange {
+		t.Fatal("not the error we expected", err)
+	}
+}